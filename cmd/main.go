@@ -7,6 +7,7 @@ import (
 	"syscall"
 
 	"github.com/ilgooz/service-webman/service"
+	"github.com/ilgooz/service-webman/webman"
 )
 
 func main() {
@@ -19,6 +20,9 @@ func main() {
 
 	go func() {
 		if err := srv.Start(); err != nil {
+			if err == webman.ErrAddrInUse {
+				log.Fatal("another process is already listening on the webhook port")
+			}
 			log.Fatal(err)
 		}
 	}()
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// eventBuffer is a file backed ring buffer of events that couldn't be emitted.
+// Each event is stored in its own file named by its sequence number to keep the order.
+type eventBuffer struct {
+	dir        string
+	maxEntries int
+
+	// seqs are the sequence numbers of buffered events from oldest to newest.
+	seqs    []uint64
+	nextSeq uint64
+	m       sync.Mutex
+}
+
+type bufferedEvent struct {
+	Key  string          `json:"key"`
+	Data json.RawMessage `json:"data"`
+}
+
+// newEventBuffer creates an eventBuffer in dir and loads the events left from previous runs.
+func newEventBuffer(dir string, maxEntries int) (*eventBuffer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	b := &eventBuffer{
+		dir:        dir,
+		maxEntries: maxEntries,
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".json")
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil || name == file.Name() {
+			continue
+		}
+		b.seqs = append(b.seqs, seq)
+	}
+	sort.Slice(b.seqs, func(i, j int) bool { return b.seqs[i] < b.seqs[j] })
+	if len(b.seqs) > 0 {
+		b.nextSeq = b.seqs[len(b.seqs)-1] + 1
+	}
+	return b, nil
+}
+
+// len returns the number of buffered events.
+func (b *eventBuffer) len() int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return len(b.seqs)
+}
+
+// push buffers data of event key. The oldest event is dropped when the buffer is full.
+func (b *eventBuffer) push(key string, data interface{}) error {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	eventBytes, err := json.Marshal(bufferedEvent{Key: key, Data: dataBytes})
+	if err != nil {
+		return err
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	seq := b.nextSeq
+	tmpPath := b.path(seq) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, eventBytes, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, b.path(seq)); err != nil {
+		return err
+	}
+	b.nextSeq++
+	b.seqs = append(b.seqs, seq)
+
+	for len(b.seqs) > b.maxEntries {
+		if err := os.Remove(b.path(b.seqs[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		b.seqs = b.seqs[1:]
+	}
+	return nil
+}
+
+// peek returns the oldest buffered event.
+func (b *eventBuffer) peek() (seq uint64, event bufferedEvent, ok bool, err error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if len(b.seqs) == 0 {
+		return 0, event, false, nil
+	}
+	seq = b.seqs[0]
+	data, err := ioutil.ReadFile(b.path(seq))
+	if err != nil {
+		return seq, event, false, err
+	}
+	return seq, event, true, json.Unmarshal(data, &event)
+}
+
+// remove removes the event with seq if it's still the oldest one.
+func (b *eventBuffer) remove(seq uint64) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if len(b.seqs) == 0 || b.seqs[0] != seq {
+		return nil
+	}
+	b.seqs = b.seqs[1:]
+	return os.Remove(b.path(seq))
+}
+
+// flush emits buffered events in order with emit until it fails or the buffer is empty.
+func (b *eventBuffer) flush(emit func(key string, data interface{}) error) error {
+	for {
+		seq, event, ok, err := b.peek()
+		if err != nil {
+			// drop the unreadable event so it doesn't block the buffer.
+			b.remove(seq)
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if err := emit(event.Key, event.Data); err != nil {
+			return err
+		}
+		if err := b.remove(seq); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *eventBuffer) path(seq uint64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%020d.json", seq))
+}
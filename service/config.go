@@ -0,0 +1,52 @@
+package service
+
+import "time"
+
+// WebhookConfig is the configuration of the service's webhook server.
+type WebhookConfig struct {
+	// Enabled reports whether the webhook server is not disabled.
+	Enabled bool
+
+	Endpoint string
+	Addr     string
+
+	// TLS reports whether the webhook server is served with tls.
+	TLS bool
+
+	// ListenAddr is the actual listening address of the running webhook server.
+	// It's empty while the server is not listening.
+	ListenAddr string
+
+	// Schema reports whether webhook bodies are validated against a json schema.
+	Schema bool
+
+	// DedupHeader is the header of the ids that duplicate requests are rejected by.
+	DedupHeader string
+
+	// TimestampHeader is the header of the sending times that are validated
+	// within TimestampTolerance.
+	TimestampHeader    string
+	TimestampTolerance time.Duration
+
+	// Headers are the allowed headers included in webhook events.
+	Headers []string
+}
+
+// WebhookConfig returns the configuration of the webhook server.
+func (s *Service) WebhookConfig() WebhookConfig {
+	c := WebhookConfig{
+		Enabled:            !s.webhookDisabled,
+		Endpoint:           s.webhookEndpoint,
+		Addr:               s.webhookAddr,
+		TLS:                s.webhookTLS,
+		Schema:             s.webhookSchemaBytes != nil,
+		DedupHeader:        s.dedupHeader,
+		TimestampHeader:    s.timestampHeader,
+		TimestampTolerance: s.timestampTolerance,
+		Headers:            append([]string{}, s.webhookHeaders...),
+	}
+	if app, ok := s.webman.(webhookAddresser); ok && c.Enabled {
+		c.ListenAddr = app.WebhookAddr()
+	}
+	return c
+}
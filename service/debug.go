@@ -0,0 +1,58 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// eventRing keeps the last emitted webhook events up to a max number of events.
+type eventRing struct {
+	events []Event
+	next   int
+	full   bool
+	m      sync.Mutex
+}
+
+func newEventRing(n int) *eventRing {
+	return &eventRing{events: make([]Event, n)}
+}
+
+// push adds event by overwriting the oldest one when the ring is full.
+func (r *eventRing) push(event Event) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.events[r.next] = event
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the events from the oldest to the most recent.
+func (r *eventRing) list() []Event {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if !r.full {
+		return append([]Event{}, r.events[:r.next]...)
+	}
+	return append(append([]Event{}, r.events[r.next:]...), r.events[:r.next]...)
+}
+
+// debugEventsMiddleware replies GET requests to path with the events of ring
+// and passes the others to next.
+func debugEventsMiddleware(path string, ring *eventRing) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || r.URL.Path != path {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(ring.list()); err != nil {
+				log.Printf("error while writing debug events: %s", err)
+			}
+		})
+	}
+}
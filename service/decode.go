@@ -0,0 +1,129 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeForm = "application/x-www-form-urlencoded"
+	contentTypeText = "text/plain"
+)
+
+// bodyDecoders decodes webhook request bodies per content type.
+// Bodies of other content types are decoded by the webhook decoder which is json by default.
+var bodyDecoders = map[string]func(*http.Request) (interface{}, error){
+	contentTypeForm: decodeFormBody,
+	contentTypeText: decodeTextBody,
+}
+
+// decodeWebhookBody decodes the body of req by its content type if the type is accepted.
+// Body decoded with the webhook decoder for other content types.
+// Bodies of requests other than POST are nil when they're not sent.
+func (s *Service) decodeWebhookBody(req *http.Request) (interface{}, error) {
+	if req.Method != http.MethodPost && req.Body == http.NoBody {
+		return nil, nil
+	}
+	if s.webhookEmptyBody {
+		empty, err := isEmptyBody(req)
+		if err != nil {
+			return nil, err
+		}
+		if empty {
+			return s.webhookDefaultBody, nil
+		}
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if decoder, ok := bodyDecoders[mediaType]; ok && s.webhookContentTypes[mediaType] {
+		return decoder(req)
+	}
+	if s.webhookDecoder != nil {
+		return s.webhookDecoder(req.Body)
+	}
+	return s.webhookJSON.decode(req.Body)
+}
+
+// isEmptyBody reports whether the body of req is empty by peeking it
+// without consuming it.
+func isEmptyBody(req *http.Request) (bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true, nil
+	}
+	br := bufio.NewReader(req.Body)
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, req.Body}
+	if _, err := br.Peek(1); err != nil {
+		if err == io.EOF {
+			return true, nil
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// jsonDecoding configures the default json decoding of webhook request bodies.
+type jsonDecoding struct {
+	// useNumber decodes numbers as json.Number instead of float64.
+	useNumber bool
+
+	// disallowUnknownFields rejects the fields that bodyType doesn't have.
+	disallowUnknownFields bool
+
+	// bodyType is the type that bodies decoded into when set.
+	bodyType reflect.Type
+}
+
+func (d jsonDecoding) decode(r io.Reader) (interface{}, error) {
+	dec := json.NewDecoder(r)
+	if d.useNumber {
+		dec.UseNumber()
+	}
+	if d.disallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if d.bodyType != nil {
+		out := reflect.New(d.bodyType).Interface()
+		if err := dec.Decode(out); err != nil {
+			return nil, errors.New("json data payload expected")
+		}
+		return out, nil
+	}
+	var out interface{}
+	if err := dec.Decode(&out); err != nil {
+		return nil, errors.New("json data payload expected")
+	}
+	return out, nil
+}
+
+// decodeFormBody decodes form values to strings or to lists of strings for multi values.
+func decodeFormBody(req *http.Request) (interface{}, error) {
+	if err := req.ParseForm(); err != nil {
+		return nil, errors.New("form data payload expected")
+	}
+	out := map[string]interface{}{}
+	for key, values := range req.PostForm {
+		if len(values) == 1 {
+			out[key] = values[0]
+			continue
+		}
+		out[key] = values
+	}
+	return out, nil
+}
+
+func decodeTextBody(req *http.Request) (interface{}, error) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
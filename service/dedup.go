@@ -0,0 +1,65 @@
+package service
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// dedupCache remembers recently seen ids up to a max number of entries and ttl.
+type dedupCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	ll    *list.List
+	items map[string]*list.Element
+	m     sync.Mutex
+}
+
+type dedupEntry struct {
+	id     string
+	seenAt time.Time
+}
+
+func newDedupCache(ttl time.Duration, maxEntries int) *dedupCache {
+	return &dedupCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+// seen reports whether id is already seen in ttl and marks it as seen otherwise.
+func (c *dedupCache) seen(id string) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	now := time.Now()
+	if e, ok := c.items[id]; ok {
+		if now.Sub(e.Value.(*dedupEntry).seenAt) < c.ttl {
+			return true
+		}
+		c.remove(e)
+	}
+
+	c.items[id] = c.ll.PushFront(&dedupEntry{id: id, seenAt: now})
+	for c.ll.Len() > c.maxEntries {
+		c.remove(c.ll.Back())
+	}
+	return false
+}
+
+// forget unmarks id so it's not seen anymore.
+func (c *dedupCache) forget(id string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if e, ok := c.items[id]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *dedupCache) remove(e *list.Element) {
+	c.ll.Remove(e)
+	delete(c.items, e.Value.(*dedupEntry).id)
+}
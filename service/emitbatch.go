@@ -0,0 +1,94 @@
+package service
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// emitBatchKeySuffix is appended to the keys of events to get the keys of their batches.
+const emitBatchKeySuffix = "Batch"
+
+// emitBatch is the data of an event that carries a batch of webhook events.
+type emitBatch struct {
+	Events []Event `json:"events"`
+}
+
+// emitBatcher coalesces the webhook events of the same keys that are emitted within
+// a flush interval into single batch events because MESG doesn't have a batch emit.
+type emitBatcher struct {
+	maxItems      int
+	flushInterval time.Duration
+
+	// emit emits the batch of events with key.
+	emit func(key string, batch emitBatch) error
+
+	pending map[string]*pendingBatch
+	m       sync.Mutex
+}
+
+type pendingBatch struct {
+	events []Event
+	timer  *time.Timer
+}
+
+func newEmitBatcher(maxItems int, flushInterval time.Duration,
+	emit func(key string, batch emitBatch) error) *emitBatcher {
+	return &emitBatcher{
+		maxItems:      maxItems,
+		flushInterval: flushInterval,
+		emit:          emit,
+		pending:       map[string]*pendingBatch{},
+	}
+}
+
+// add adds event to the batch of key. The batch is emitted when it has max items or
+// when the flush interval passes after its first event is added.
+func (b *emitBatcher) add(key string, event Event) error {
+	b.m.Lock()
+	p, ok := b.pending[key]
+	if !ok {
+		p = &pendingBatch{}
+		p.timer = time.AfterFunc(b.flushInterval, func() {
+			b.flushBatch(key, p)
+		})
+		b.pending[key] = p
+	}
+	p.events = append(p.events, event)
+	if len(p.events) < b.maxItems {
+		b.m.Unlock()
+		return nil
+	}
+	p.timer.Stop()
+	delete(b.pending, key)
+	b.m.Unlock()
+	return b.emit(key, emitBatch{Events: p.events})
+}
+
+// flushBatch emits p when it's still pending for key.
+func (b *emitBatcher) flushBatch(key string, p *pendingBatch) {
+	b.m.Lock()
+	if b.pending[key] != p {
+		b.m.Unlock()
+		return
+	}
+	delete(b.pending, key)
+	b.m.Unlock()
+	if err := b.emit(key, emitBatch{Events: p.events}); err != nil {
+		log.Printf("error while emitting an event batch: %s", err)
+	}
+}
+
+// flush emits all the pending batches.
+func (b *emitBatcher) flush() {
+	b.m.Lock()
+	pending := b.pending
+	b.pending = map[string]*pendingBatch{}
+	b.m.Unlock()
+	for key, p := range pending {
+		p.timer.Stop()
+		if err := b.emit(key, emitBatch{Events: p.events}); err != nil {
+			log.Printf("error while emitting an event batch: %s", err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+
+	"github.com/ilgooz/service-webman/webman"
+)
+
+// kinds of the errors of upstream requests.
+const (
+	errorKindTimeout           = "timeout"
+	errorKindDNS               = "dns"
+	errorKindConnectionRefused = "connection_refused"
+	errorKindConnection        = "connection"
+	errorKindDecode            = "decode"
+	errorKindStatus            = "status"
+	errorKindHost              = "host"
+	errorKindURL               = "url"
+	errorKindTooLarge          = "too_large"
+	errorKindCanceled          = "canceled"
+	errorKindUnknown           = "unknown"
+)
+
+// errorKind classifies the error of a request that is responded with statusCode
+// so callers can handle failures without parsing their messages.
+func errorKind(err error, statusCode int) string {
+	switch e := err.(type) {
+	case *timeoutError:
+		return errorKindTimeout
+	case *hostError:
+		return errorKindHost
+	case *urlError:
+		return errorKindURL
+	case *webman.ResponseTooLargeError:
+		return errorKindTooLarge
+	case *webman.DecodeError:
+		return errorKindDecode
+	case *webman.TransportError:
+		return transportErrorKind(e.Err)
+	case *net.DNSError:
+		return errorKindDNS
+	}
+	switch err {
+	case context.DeadlineExceeded:
+		return errorKindTimeout
+	case context.Canceled:
+		return errorKindCanceled
+	}
+	// the rest of the errors of responded requests are about their statuses.
+	if statusCode != 0 {
+		return errorKindStatus
+	}
+	return errorKindUnknown
+}
+
+// transportErrorKind classifies the errors of requests that fail to be sent.
+func transportErrorKind(err error) string {
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	// redirects and connections rejected by the host policy.
+	if _, ok := err.(*hostError); ok {
+		return errorKindHost
+	}
+	if operr, ok := err.(*net.OpError); ok {
+		if _, ok := operr.Err.(*hostError); ok {
+			return errorKindHost
+		}
+		if _, ok := operr.Err.(*net.DNSError); ok {
+			return errorKindDNS
+		}
+		if serr, ok := operr.Err.(*os.SyscallError); ok && serr.Err == syscall.ECONNREFUSED {
+			return errorKindConnectionRefused
+		}
+	}
+	if _, ok := err.(*net.DNSError); ok {
+		return errorKindDNS
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return errorKindTimeout
+	}
+	switch err {
+	case context.DeadlineExceeded:
+		return errorKindTimeout
+	case context.Canceled:
+		return errorKindCanceled
+	}
+	return errorKindConnection
+}
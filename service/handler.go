@@ -1,46 +1,377 @@
 package service
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	mesg "github.com/ilgooz/mesg-go"
-	uuid "github.com/satori/go.uuid"
+	"github.com/ilgooz/service-webman/webman"
 )
 
 func (s *Service) webhookHandler(req *http.Request) error {
-	var out interface{}
 	defer req.Body.Close()
-	if err := json.NewDecoder(req.Body).Decode(&out); err != nil {
-		return errors.New("json data payload expected")
+	atomic.AddInt64(&s.stats.webhookRequests, 1)
+
+	if s.webhookSem != nil {
+		if !s.acquireWebhookSlot() {
+			return &webman.StatusError{
+				Code: http.StatusTooManyRequests,
+				Err:  errors.New("too many concurrent requests"),
+			}
+		}
+		defer func() { <-s.webhookSem }()
 	}
 
-	err := s.mesgService.EmitEvent("onRequest", webhookResponse{
-		Date: time.Now().Unix(),
-		ID:   uuid.NewV4().String(),
-		Body: out,
-	})
+	if s.timestampHeader != "" {
+		if err := s.checkWebhookTimestamp(req); err != nil {
+			return &webman.StatusError{Code: http.StatusBadRequest, Err: err}
+		}
+	}
+
+	out, err := s.decodeWebhookBody(req)
 	if err != nil {
-		log.Printf("error while emitting an event: %s", err)
+		return err
+	}
+
+	err = s.handleWebhookBody(req, out)
+	if _, ok := err.(*webman.StatusError); ok {
+		return err
+	}
+	if err == nil {
+		if s.webhookSyncEmit {
+			return &webman.StatusError{Code: http.StatusOK}
+		}
+		return nil
+	}
+	if s.emitAttempts > 0 || s.webhookSyncEmit {
+		return &webman.StatusError{
+			Code: http.StatusServiceUnavailable,
+			Err:  errors.New("event could not be emitted"),
+		}
 	}
 	return nil
 }
 
-type webhookResponse struct {
-	Date int64       `json:"date"`
-	ID   string      `json:"id"`
+// handleWebhookBody validates the decoded body of webhook request req, creates its
+// events, transforms, redacts and emits them.
+// It returns the emit error of the first event that couldn't be emitted, the other
+// errors are status errors.
+func (s *Service) handleWebhookBody(req *http.Request, body interface{}) error {
+	if s.webhookSchema != nil {
+		if err := s.validateWebhookBody(body); err != nil {
+			return err
+		}
+	}
+
+	events := s.webhookEvents(req, body)
+	if s.webhookTransform != nil {
+		for i := range events {
+			if err := s.webhookTransform(req, &events[i]); err != nil {
+				return &webman.StatusError{Code: http.StatusBadRequest, Err: err}
+			}
+		}
+	}
+
+	for _, event := range events {
+		for _, path := range s.redactPaths {
+			redact(event.Body, path)
+		}
+	}
+
+	var dedupID string
+	if s.dedup != nil {
+		if dedupID = req.Header.Get(s.dedupHeader); dedupID != "" && s.dedup.seen(dedupID) {
+			return &webman.StatusError{Code: http.StatusOK}
+		}
+	}
+
+	var emitErr error
+	for _, event := range events {
+		if err := s.emitWebhookEvent(event); err != nil {
+			log.Printf("error while emitting an event: %s", err)
+			// let the provider's redelivery through since this one is not emitted.
+			if dedupID != "" {
+				s.dedup.forget(dedupID)
+			}
+			if s.emitAttempts > 0 {
+				return err
+			}
+			if emitErr == nil {
+				emitErr = err
+			}
+		}
+	}
+	return emitErr
+}
+
+// checkWebhookTimestamp checks if the timestamp header of req is within the tolerance.
+func (s *Service) checkWebhookTimestamp(req *http.Request) error {
+	value := req.Header.Get(s.timestampHeader)
+	if value == "" {
+		return fmt.Errorf("%s header is missing", s.timestampHeader)
+	}
+	var sent time.Time
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		sent = time.Unix(seconds, 0)
+	} else if sent, err = time.Parse(time.RFC3339, value); err != nil {
+		return fmt.Errorf("invalid %s header", s.timestampHeader)
+	}
+	diff := s.now().Sub(sent)
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > s.timestampTolerance {
+		return errors.New("request timestamp is outside of the tolerance")
+	}
+	return nil
+}
+
+// webhookEvents creates the events of webhook request req with decoded body.
+func (s *Service) webhookEvents(req *http.Request, body interface{}) []Event {
+	event := Event{
+		ID:         webman.RequestID(req.Context()),
+		Body:       body,
+		Headers:    s.webhookRequestHeaders(req),
+		RemoteAddr: req.RemoteAddr,
+		key:        s.webhookEventKey(req),
+	}
+	if s.methodEventKeys {
+		event.key += "." + req.Method
+	}
+	items, ok := body.([]interface{})
+	if !ok || !s.webhookFanOut {
+		return []Event{event}
+	}
+	events := make([]Event, len(items))
+	for i, item := range items {
+		events[i] = event
+		events[i].ID = ""
+		events[i].Body = item
+	}
+	return events
+}
+
+// webhookEventKey returns the key of events emitted for req.
+func (s *Service) webhookEventKey(req *http.Request) string {
+	if s.tenantHeader != "" {
+		if tenant := req.Header.Get(s.tenantHeader); tenant != "" {
+			return s.tenantPrefix + tenant
+		}
+	}
+	key, longest := "", -1
+	for prefix, routeKey := range s.routeKeys {
+		if strings.HasPrefix(req.URL.Path, prefix) && len(prefix) > longest {
+			key, longest = routeKey, len(prefix)
+		}
+	}
+	if key != "" {
+		return key
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if hostKey, ok := s.hostKeys[strings.ToLower(host)]; ok {
+		return hostKey
+	}
+	return s.eventKey
+}
+
+// emitWebhookEvent fills the missing id and date of event and emits it.
+// It retries on failures when emit retries are configured and buffers the event
+// when it still can't be emitted and the event buffer is enabled.
+func (s *Service) emitWebhookEvent(event Event) error {
+	if event.ID == "" {
+		event.ID = s.newID()
+	}
+	now := s.now()
+	event.Date = now.Unix()
+	event.Timestamp = now.UnixNano() / int64(time.Millisecond)
+	if s.webhookSequence {
+		event.Sequence = atomic.AddInt64(&s.sequence, 1)
+	}
+
+	if s.localEvents != nil {
+		select {
+		case s.localEvents <- event:
+		default:
+			atomic.AddInt64(&s.droppedLocalEvents, 1)
+		}
+	}
+
+	if s.eventFields != (eventFields{}) {
+		event.fields = &s.eventFields
+	}
+
+	if s.debugEvents != nil {
+		s.debugEvents.push(event)
+	}
+
+	key := event.key
+	if key == "" {
+		key = s.eventKey
+	}
+
+	if s.emitBatcher != nil {
+		return s.emitBatcher.add(key, event)
+	}
+
+	if s.eventBuffer == nil {
+		return s.emitWithRetry(key, event)
+	}
+	// keep the order of events while there are buffered ones.
+	if s.eventBuffer.len() == 0 {
+		err := s.emitWithRetry(key, event)
+		if err == nil {
+			return nil
+		}
+		log.Printf("error while emitting an event, buffering it: %s", err)
+	}
+	return s.eventBuffer.push(key, event)
+}
+
+func (s *Service) emitWithRetry(key string, data interface{}) error {
+	delay := s.emitDelay
+	for attempt := 1; ; attempt++ {
+		err := s.emitEvent(key, data)
+		if err == nil || attempt >= s.emitAttempts {
+			return err
+		}
+		log.Printf("error while emitting an event, retrying in %s: %s", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// emitEvent emits an event to MESG and keeps track of the failures.
+func (s *Service) emitEvent(key string, data interface{}) error {
+	err := s.mesgService.EmitEvent(key, data)
+	if err != nil {
+		atomic.StoreInt32(&s.emitFailing, 1)
+	} else {
+		atomic.StoreInt32(&s.emitFailing, 0)
+	}
+	return err
+}
+
+// acquireWebhookSlot waits for a free webhook slot up to the configured wait duration.
+func (s *Service) acquireWebhookSlot() bool {
+	select {
+	case s.webhookSem <- struct{}{}:
+		return true
+	default:
+	}
+	if s.webhookSemWait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(s.webhookSemWait)
+	defer timer.Stop()
+	select {
+	case s.webhookSem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// webhookRequestHeaders returns the allowed headers of req.
+func (s *Service) webhookRequestHeaders(req *http.Request) map[string]string {
+	if len(s.webhookHeaders) == 0 {
+		return nil
+	}
+	headers := map[string]string{}
+	for _, key := range s.webhookHeaders {
+		if value := req.Header.Get(key); value != "" {
+			headers[key] = value
+		}
+	}
+	return headers
+}
+
+// Event is a webhook event emitted for a received webhook request.
+type Event struct {
+	// Date and Timestamp are the emit time of event in seconds and milliseconds.
+	Date      int64 `json:"date"`
+	Timestamp int64 `json:"timestamp"`
+
+	// ID is the request id of event, a new one is generated when it's empty.
+	ID string `json:"id"`
+
+	// Body is the decoded webhook body.
 	Body interface{} `json:"body"`
+
+	// Headers are the allowed headers of webhook request.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+
+	// Sequence increases by one for each emitted event starting from 1
+	// when sequences are enabled.
+	Sequence int64 `json:"sequence,omitempty"`
+
+	// key is the event key, it defaults to the service's event key.
+	key string
+
+	// fields renames the json keys of event when set.
+	fields *eventFields
+}
+
+// eventFields are the json keys of webhook event fields.
+type eventFields struct {
+	body string
+	date string
+	id   string
+}
+
+// MarshalJSON encodes event by renaming its keys with the custom fields.
+func (e Event) MarshalJSON() ([]byte, error) {
+	type event Event
+	data, err := json.Marshal(event(e))
+	if err != nil || e.fields == nil {
+		return data, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for key, newKey := range map[string]string{
+		"body": e.fields.body,
+		"date": e.fields.date,
+		"id":   e.fields.id,
+	} {
+		if newKey != "" && newKey != key {
+			fields[newKey] = fields[key]
+			delete(fields, key)
+		}
+	}
+	return json.Marshal(fields)
 }
 
 func (s *Service) executeHandler(req *mesg.Request) {
+	atomic.AddInt64(&s.stats.tasksExecuted, 1)
 	var hreq httpRequest
 
-	if err := req.Get(&hreq); err != nil {
-		if err := req.Reply("error", httpErrorResponse{
+	err := req.Get(&hreq)
+	if err == nil && len(hreq.URLs) > 0 {
+		if hreq.URL != "" {
+			err = errors.New("url and urls can't be set together")
+		} else {
+			s.executeFanOut(req, hreq)
+			return
+		}
+	}
+	if err != nil {
+		if err := req.Reply(s.keys.errorOutput, httpErrorResponse{
 			Message: fmt.Sprintf("err while decoding input data: %s", err),
 		}); err != nil {
 			log.Printf("error while reply: %s", err)
@@ -48,42 +379,113 @@ func (s *Service) executeHandler(req *mesg.Request) {
 		return
 	}
 
-	responseC := make(chan response, 1)
-	s.doPOSTRequest(hreq, responseC)
-	resp := <-responseC
+	resp := s.doPOSTRequest(context.Background(), hreq)
 
 	if resp.Error != nil {
-		if err := req.Reply("error", httpErrorResponse{
-			Message: fmt.Sprintf("err while performing the post request: %s", resp.Error),
+		if err := req.Reply(s.keys.errorOutput, httpErrorResponse{
+			Message:    executeErrorMessage(resp.Error),
+			StatusCode: resp.StatusCode,
+			Kind:       errorKind(resp.Error, resp.StatusCode),
+			Body:       resp.Body,
 		}); err != nil {
 			log.Printf("error while reply: %s", err)
 		}
 		return
 	}
 
-	if err := req.Reply("success", httpSuccessResponse{
+	if err := req.Reply(s.keys.successOutput, httpSuccessResponse{
 		StatusCode: resp.StatusCode,
 		Body:       resp.Body,
+		Status:     resp.Status,
+		Proto:      resp.Proto,
+		URL:        resp.ServedURL,
 	}); err != nil {
 		log.Printf("error while reply: %s", err)
 	}
 }
 
 func (s *Service) batchExecuteHandler(req *mesg.Request) {
-	var hreq httpBatchRequest
-	if err := req.Get(&hreq); err != nil {
-		if err := req.Reply("error", httpErrorResponse{
-			Message: fmt.Sprintf("err while decoding batch input data: %s", err),
+	atomic.AddInt64(&s.stats.batchesProcessed, 1)
+	hreq, err := decodeBatchRequest(req)
+	if err == nil {
+		err = s.validateBatch(hreq)
+	}
+	if err != nil {
+		if err := req.Reply(s.keys.errorOutput, httpErrorResponse{
+			Message: err.Error(),
 		}); err != nil {
 			log.Printf("error while reply: %s", err)
 		}
 		return
 	}
+	s.executeBatch(req, hreq)
+}
 
-	responseC := make(chan response, 0)
+// executeErrorMessage describes the failure of an execute request by its cause.
+func executeErrorMessage(err error) string {
+	switch err.(type) {
+	case *timeoutError, *hostError, *urlError, *webman.ResponseTooLargeError:
+		return err.Error()
+	case *webman.DecodeError:
+		return fmt.Sprintf("err while decoding the response: %s", err)
+	case *webman.TransportError:
+		return fmt.Sprintf("err while sending the request: %s", err)
+	default:
+		return fmt.Sprintf("err while performing the post request: %s", err)
+	}
+}
 
-	for _, hreq := range hreq.Batch {
-		go s.doPOSTRequest(hreq, responseC)
+// executeFanOut sends hreq to each of its urls as a batch.
+func (s *Service) executeFanOut(req *mesg.Request, hreq httpRequest) {
+	batch := httpBatchRequest{Batch: make([]httpRequest, len(hreq.URLs))}
+	for i, url := range hreq.URLs {
+		batch.Batch[i] = hreq
+		batch.Batch[i].URL = url
+		batch.Batch[i].URLs = nil
+	}
+	if err := s.validateBatch(batch); err != nil {
+		if err := req.Reply(s.keys.errorOutput, httpErrorResponse{
+			Message: err.Error(),
+		}); err != nil {
+			log.Printf("error while reply: %s", err)
+		}
+		return
+	}
+	s.executeBatch(req, batch)
+}
+
+// executeBatch performs the requests of hreq concurrently and replies their results.
+func (s *Service) executeBatch(req *mesg.Request, hreq httpBatchRequest) {
+	ctx := context.Background()
+	var deadlineC <-chan struct{}
+	if s.batchDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.batchDeadline)
+		defer cancel()
+		deadlineC = ctx.Done()
+	}
+
+	// buffered to not block the requests that finish after the deadline.
+	responseC := make(chan response, len(hreq.Batch))
+	pending := map[string]int{}
+
+	for _, r := range hreq.Batch {
+		pending[r.URL]++
+		if r.Body == nil && hreq.BodyTemplate != nil {
+			r.Body = renderTemplate(hreq.BodyTemplate, r.Vars)
+		}
+		if r.Body == nil {
+			r.Body = hreq.DefaultBody
+		}
+		if r.ContentType == "" {
+			r.ContentType = hreq.ContentType
+		}
+		go func(r httpRequest) {
+			start := time.Now()
+			resp := s.doPOSTRequest(ctx, r)
+			resp.Duration = time.Since(start)
+			responseC <- resp
+		}(r)
 	}
 
 	hresp := httpBatchResponse{
@@ -94,61 +496,412 @@ func (s *Service) batchExecuteHandler(req *mesg.Request) {
 	}
 
 	totalReqs := len(hreq.Batch)
+	var (
+		completed, successes, errs int
+		totalDuration              time.Duration
+	)
+collect:
 	for i := 0; i < totalReqs; i++ {
-		resp := <-responseC
+		var resp response
+		select {
+		case resp = <-responseC:
+		case <-deadlineC:
+			for url, count := range pending {
+				if count > 0 {
+					errs += count
+					hresp.Batch.Errors[url] = httpErrorResponse{
+						Message: fmt.Sprintf("batch deadline of %s exceeded", s.batchDeadline),
+						Kind:    errorKindTimeout,
+					}
+				}
+			}
+			break collect
+		}
+		pending[resp.URL]--
+		completed++
+		totalDuration += resp.Duration
 
 		if resp.Error != nil {
+			errs++
 			hresp.Batch.Errors[resp.URL] = httpErrorResponse{
-				Message: resp.Error.Error(),
+				Message:    resp.Error.Error(),
+				StatusCode: resp.StatusCode,
+				Kind:       errorKind(resp.Error, resp.StatusCode),
+				Body:       resp.Body,
+			}
+		} else {
+			successes++
+			hresp.Batch.Successes[resp.URL] = httpSuccessResponse{
+				StatusCode: resp.StatusCode,
+				Body:       resp.Body,
+				Status:     resp.Status,
+				Proto:      resp.Proto,
+				URL:        resp.ServedURL,
 			}
-			continue
 		}
+	}
 
-		hresp.Batch.Successes[resp.URL] = httpSuccessResponse{
-			StatusCode: resp.StatusCode,
-			Body:       resp.Body,
-		}
+	hresp.Summary = batchSummary{
+		Total:         totalReqs,
+		Successes:     successes,
+		Errors:        errs,
+		TotalDuration: milliseconds(totalDuration),
+	}
+	// average only the requests that are completed before the deadline.
+	if completed > 0 {
+		hresp.Summary.AvgDuration = milliseconds(totalDuration / time.Duration(completed))
 	}
 
-	if err := req.Reply("batch", hresp); err != nil {
+	if err := req.Reply(s.keys.batchOutput, hresp); err != nil {
 		log.Printf("error while reply: %s", err)
 	}
 }
 
-func (s *Service) doPOSTRequest(hreq httpRequest, responseC chan response) {
+// decodeBatchRequest decodes batch input data of req.
+// It reports malformed input data, missing and non array batch fields distinctly.
+func decodeBatchRequest(req *mesg.Request) (httpBatchRequest, error) {
+	var hreq httpBatchRequest
+	var fields map[string]json.RawMessage
+	if err := req.Get(&fields); err != nil {
+		return hreq, fmt.Errorf("err while decoding batch input data: %s", err)
+	}
+	batch, ok := fields["batch"]
+	if !ok || string(batch) == "null" {
+		return hreq, errors.New("batch field is missing")
+	}
+	if err := json.Unmarshal(batch, &hreq.Batch); err != nil {
+		return hreq, fmt.Errorf("batch must be an array of requests: %s", err)
+	}
+	return hreq, req.Get(&hreq)
+}
+
+func (s *Service) validateBatch(hreq httpBatchRequest) error {
+	if len(hreq.Batch) == 0 {
+		return errors.New("batch is empty")
+	}
+	if s.maxBatchSize > 0 && len(hreq.Batch) > s.maxBatchSize {
+		return fmt.Errorf("batch size %d exceeds the limit of %d", len(hreq.Batch), s.maxBatchSize)
+	}
+	return nil
+}
+
+// doPOSTRequest performs hreq and sends it to its fallback url when it fails.
+// The error is reported only when the fallback fails too.
+func (s *Service) doPOSTRequest(ctx context.Context, hreq httpRequest) response {
+	resp := s.doRequest(ctx, hreq)
+	if hreq.FallbackURL != "" {
+		resp.ServedURL = hreq.URL
+	}
+	// requests refused by the url validation or the host policy aren't sent elsewhere.
+	if hreq.FallbackURL != "" && resp.Error != nil && !isPolicyError(resp.Error) {
+		log.Printf("request to %s failed, sending it to the fallback url: %s", hreq.URL, resp.Error)
+		fallback := hreq
+		fallback.URL = hreq.FallbackURL
+		fallback.FallbackURL = ""
+		resp = s.doRequest(ctx, fallback)
+		// keep the primary url to report the results of batches by it.
+		resp.URL = hreq.URL
+		resp.ServedURL = fallback.URL
+	}
+	if resp.Error != nil {
+		s.reportError(resp)
+	}
+	return resp
+}
+
+// isPolicyError reports whether err is caused by refusing the url of a request.
+func isPolicyError(err error) bool {
+	switch errorKind(err, 0) {
+	case errorKindHost, errorKindURL:
+		return true
+	}
+	return false
+}
+
+func (s *Service) doRequest(ctx context.Context, hreq httpRequest) response {
 	resp := response{URL: hreq.URL}
 
-	statusCode, err := s.webman.Post(hreq.URL, hreq.Body, &resp.Body)
+	if s.validateURLs {
+		url, err := normalizeURL(hreq.URL)
+		if err != nil {
+			resp.Error = err
+			return resp
+		}
+		hreq.URL = url
+	}
+
+	if s.hosts.enabled() {
+		if err := s.hosts.check(hreq.URL); err != nil {
+			resp.Error = err
+			return resp
+		}
+	}
+
+	if s.dryRun {
+		resp.StatusCode = http.StatusOK
+		resp.Body = hreq.Body
+		return resp
+	}
+
+	var cacheKey string
+	if s.responseCache != nil && strings.EqualFold(hreq.Method, http.MethodGet) {
+		var err error
+		if cacheKey, err = responseCacheKey(hreq); err != nil {
+			log.Printf("error while creating response cache key: %s", err)
+		} else if cached, ok := s.responseCache.get(cacheKey); ok {
+			return cached
+		}
+	}
+
+	if s.upstreamSem != nil {
+		if err := s.upstreamSem.acquire(ctx, hreq.Priority); err != nil {
+			resp.Error = err
+			return resp
+		}
+		defer s.upstreamSem.release()
+	}
+
+	parentCtx := ctx
+	timeout := time.Duration(hreq.Timeout) * time.Millisecond
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	header := http.Header{}
+	if hreq.ContentType != "" {
+		header.Set("Content-Type", hreq.ContentType)
+	}
+	if hreq.Username != "" || hreq.Password != "" {
+		header.Set("Authorization", "Basic "+basicAuth(hreq.Username, hreq.Password))
+	}
+
+	hresp, err := s.doer.Do(ctx, &webman.Request{
+		Method:             strings.ToUpper(hreq.Method),
+		URL:                hreq.URL,
+		Header:             header,
+		Body:               hreq.Body,
+		InsecureSkipVerify: hreq.InsecureSkipVerify,
+		MaxResponseBytes:   hreq.MaxResponseBytes,
+	})
+	if hresp != nil {
+		resp.StatusCode = hresp.StatusCode
+		if s.statusLine {
+			resp.Status = hresp.Status
+			resp.Proto = hresp.Proto
+		}
+	}
 	if err != nil {
 		resp.Error = err
-		responseC <- resp
-		return
+		// report the request's own timeout instead of the errors of the canceled request.
+		if timeout > 0 && ctx.Err() == context.DeadlineExceeded && parentCtx.Err() == nil {
+			resp.Error = &timeoutError{timeout: timeout}
+		}
+		return resp
+	}
+
+	var decodeErr error
+	if hreq.Raw {
+		resp.Body = string(hresp.Body)
+	} else if decodeErr = json.Unmarshal(hresp.Body, &resp.Body); decodeErr != nil {
+		// keep bodies that aren't json to report them.
+		resp.Body = string(hresp.Body)
+	}
+
+	// unexpected statuses are reported before the decoding errors of their bodies.
+	switch {
+	case hreq.ExpectStatus != nil && !hreq.ExpectStatus.match(resp.StatusCode):
+		body, _ := json.Marshal(resp.Body)
+		resp.Error = fmt.Errorf("unexpected status code %d, expected %s: %s", resp.StatusCode, hreq.ExpectStatus, body)
+	case decodeErr != nil && resp.StatusCode >= 400:
+		resp.Error = fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, hresp.Body)
+	case decodeErr != nil:
+		resp.Error = &webman.DecodeError{Err: decodeErr}
+	}
+	if resp.Error == nil && cacheKey != "" {
+		s.responseCache.set(cacheKey, resp)
+	}
+	return resp
+}
+
+// timeoutError is the error of requests that aren't completed in their timeouts.
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("upstream request timed out after %s", e.timeout)
+}
+
+// milliseconds converts d to milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// basicAuth encodes username and password for the basic Authorization header.
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// reportError counts the failed upstream request and emits an error event for it.
+func (s *Service) reportError(resp response) {
+	atomic.AddInt64(&s.stats.upstreamErrors, 1)
+	if err := s.emitEvent(s.errorEventKey, errorEvent{
+		URL:        resp.URL,
+		StatusCode: resp.StatusCode,
+		Message:    resp.Error.Error(),
+	}); err != nil {
+		log.Printf("error while emitting an event: %s", err)
 	}
+}
 
-	resp.StatusCode = statusCode
-	responseC <- resp
+type errorEvent struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"statusCode"`
+	Message    string `json:"message"`
 }
 
 type httpRequest struct {
 	URL  string      `json:"url"`
 	Body interface{} `json:"body"`
+
+	// URLs makes the request sent to each url instead of URL and
+	// replied like a batch.
+	URLs []string `json:"urls"`
+
+	// Method of the request, it defaults to POST.
+	Method string `json:"method"`
+
+	// Timeout is the request deadline in milliseconds.
+	// Client's timeout is used when it's not set.
+	Timeout int64 `json:"timeout"`
+
+	// Raw makes the response body returned as string without decoding it as json.
+	Raw bool `json:"raw"`
+
+	// ExpectStatus makes the request fail when the response status doesn't match.
+	ExpectStatus *statusRange `json:"expectStatus"`
+
+	// Username and Password are sent as basic auth credentials when set.
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// ContentType overrides the json content type of the request.
+	// Body is still encoded as json.
+	ContentType string `json:"contentType"`
+
+	// InsecureSkipVerify disables tls certificate verification of the request.
+	// It's meant for development with self-signed certificates.
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+
+	// Priority orders the requests waiting for the global concurrency limit,
+	// higher ones are sent first.
+	Priority int `json:"priority"`
+
+	// MaxResponseBytes overrides the size limit of the response body when it's set.
+	MaxResponseBytes int64 `json:"maxResponseBytes"`
+
+	// FallbackURL is sent the same request when the request to URL fails
+	// with an error or an unexpected status. It's not used when URL is refused
+	// by the url validation or the host policy.
+	FallbackURL string `json:"fallbackURL"`
+
+	// Vars replace the ${var} tokens of the batch body template.
+	Vars map[string]string `json:"vars"`
+}
+
+// statusRange is an inclusive range of http status codes.
+// It's decoded from a status code like 200 or a range like "200-299" or "2xx".
+type statusRange struct {
+	min, max int
+}
+
+func (r *statusRange) UnmarshalJSON(data []byte) error {
+	var code int
+	if err := json.Unmarshal(data, &code); err == nil {
+		r.min, r.max = code, code
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("status must be a number or a range")
+	}
+	if len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx") && s[0] >= '1' && s[0] <= '5' {
+		r.min = int(s[0]-'0') * 100
+		r.max = r.min + 99
+		return nil
+	}
+	if _, err := fmt.Sscanf(s, "%d-%d", &r.min, &r.max); err != nil || r.min > r.max {
+		return fmt.Errorf("invalid status range %q", s)
+	}
+	return nil
+}
+
+func (r statusRange) match(code int) bool {
+	return code >= r.min && code <= r.max
+}
+
+func (r statusRange) String() string {
+	if r.min == r.max {
+		return strconv.Itoa(r.min)
+	}
+	return fmt.Sprintf("%d-%d", r.min, r.max)
 }
 
 type httpSuccessResponse struct {
 	StatusCode int         `json:"statusCode"`
 	Body       interface{} `json:"body"`
+
+	// Status and Proto are the status line and protocol of the response when enabled.
+	Status string `json:"status,omitempty"`
+	Proto  string `json:"proto,omitempty"`
+
+	// URL is the url that replied the response when there is a fallback url.
+	URL string `json:"url,omitempty"`
 }
 
 type httpErrorResponse struct {
-	Message string `json:"message"`
+	Message    string `json:"message"`
+	StatusCode int    `json:"statusCode,omitempty"`
+
+	// Kind classifies the error of the failed request, e.g. timeout, dns,
+	// connection_refused, decode or status.
+	Kind string `json:"kind,omitempty"`
+
+	// Body is the response body of the failed request if any.
+	Body interface{} `json:"body,omitempty"`
 }
 
 type httpBatchRequest struct {
 	Batch []httpRequest `json:"batch"`
+
+	// DefaultBody is sent for the requests that don't have a body.
+	DefaultBody interface{} `json:"defaultBody"`
+
+	// BodyTemplate is sent for the requests that don't have a body after
+	// the ${var} tokens in its strings are replaced with the vars of requests.
+	// It takes precedence over DefaultBody.
+	BodyTemplate interface{} `json:"bodyTemplate"`
+
+	// ContentType is used for the requests that don't have a content type.
+	ContentType string `json:"contentType"`
 }
 
 type httpBatchResponse struct {
-	Batch httpBatchResponseBody `json:"batch"`
+	Batch   httpBatchResponseBody `json:"batch"`
+	Summary batchSummary          `json:"summary"`
+}
+
+// batchSummary reports the results and timings of a batch.
+// Durations are in milliseconds.
+type batchSummary struct {
+	Total         int     `json:"total"`
+	Successes     int     `json:"successes"`
+	Errors        int     `json:"errors"`
+	TotalDuration float64 `json:"totalDuration"`
+	AvgDuration   float64 `json:"avgDuration"`
 }
 
 type httpBatchResponseBody struct {
@@ -158,7 +911,11 @@ type httpBatchResponseBody struct {
 
 type response struct {
 	URL        string
+	ServedURL  string
 	StatusCode int
+	Status     string
+	Proto      string
 	Body       interface{}
 	Error      error
+	Duration   time.Duration
 }
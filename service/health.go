@@ -0,0 +1,72 @@
+package service
+
+import (
+	"log"
+	"sync/atomic"
+
+	mesg "github.com/ilgooz/mesg-go"
+)
+
+const (
+	healthStatusHealthy   = "healthy"
+	healthStatusUnhealthy = "unhealthy"
+)
+
+// webhookAddresser is implemented by applications that report their webhook listening address.
+type webhookAddresser interface {
+	WebhookAddr() string
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+
+	// Uptime is in seconds.
+	Uptime float64 `json:"uptime"`
+
+	// Webhook reports whether the webhook server is listening.
+	Webhook bool `json:"webhook"`
+
+	// Mesg reports whether the events are emitted to MESG without errors.
+	Mesg bool `json:"mesg"`
+}
+
+// lifecycleEvent is the data of events emitted when the service starts and stops.
+type lifecycleEvent struct {
+	Version string `json:"version"`
+
+	// Uptime is in seconds.
+	Uptime float64 `json:"uptime"`
+}
+
+// emitLifecycleEvent emits the lifecycle event with key.
+func (s *Service) emitLifecycleEvent(key string) {
+	if err := s.emitEvent(key, lifecycleEvent{
+		Version: s.version,
+		Uptime:  s.now().Sub(s.startedAt).Seconds(),
+	}); err != nil {
+		log.Printf("error while emitting an event: %s", err)
+	}
+}
+
+func (s *Service) healthHandler(req *mesg.Request) {
+	if err := req.Reply(s.keys.healthOutput, s.health()); err != nil {
+		log.Printf("error while reply: %s", err)
+	}
+}
+
+func (s *Service) health() healthResponse {
+	h := healthResponse{
+		Uptime: s.now().Sub(s.startedAt).Seconds(),
+		Mesg:   atomic.LoadInt32(&s.emitFailing) == 0,
+	}
+	if !s.webhookDisabled {
+		if app, ok := s.webman.(webhookAddresser); ok {
+			h.Webhook = app.WebhookAddr() != ""
+		}
+	}
+	h.Status = healthStatusHealthy
+	if !h.Mesg || (!s.webhookDisabled && !h.Webhook) {
+		h.Status = healthStatusUnhealthy
+	}
+	return h
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// privateIPNets are the loopback, link-local and private ranges blocked
+// by BlockPrivateIPsOption.
+var privateIPNets = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range privateIPNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPolicy restricts the hosts that upstream requests can be sent to.
+// Hosts of requests are checked before they're sent and while following their redirects,
+// ips are checked while connecting so hosts can't resolve to other ips after they're checked.
+type hostPolicy struct {
+	// allowed are the only hosts requests sent to when set.
+	allowed []string
+
+	// denied are the hosts that requests aren't sent to.
+	denied []string
+
+	// blockPrivateIPs rejects the hosts that resolve to private ips.
+	blockPrivateIPs bool
+}
+
+func (p *hostPolicy) enabled() bool {
+	return len(p.allowed) > 0 || len(p.denied) > 0 || p.blockPrivateIPs
+}
+
+// hostError is the error of requests to hosts that aren't allowed.
+type hostError struct {
+	host   string
+	reason string
+}
+
+func (e *hostError) Error() string {
+	return fmt.Sprintf("host %q is not allowed: %s", e.host, e.reason)
+}
+
+// check returns an error when requests to the host of rawurl aren't allowed.
+func (p *hostPolicy) check(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	return p.checkHost(u.Hostname())
+}
+
+// checkRedirect rejects the redirects of requests to hosts that aren't allowed.
+func (p *hostPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	return p.checkHost(req.URL.Hostname())
+}
+
+func (p *hostPolicy) checkHost(host string) error {
+	host = strings.ToLower(host)
+	if matchHost(host, p.denied) {
+		return &hostError{host: host, reason: "denied"}
+	}
+	if len(p.allowed) > 0 && !matchHost(host, p.allowed) {
+		return &hostError{host: host, reason: "not in the allowed hosts"}
+	}
+	if ip := net.ParseIP(host); ip != nil && p.blockPrivateIPs && isPrivateIP(ip) {
+		return &hostError{host: host, reason: "private ip"}
+	}
+	return nil
+}
+
+// dialControl rejects the connections to denied and private ips that hosts resolve to.
+func (p *hostPolicy) dialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if matchHost(host, p.denied) {
+		return &hostError{host: host, reason: "denied"}
+	}
+	if ip := net.ParseIP(host); ip != nil && p.blockPrivateIPs && isPrivateIP(ip) {
+		return &hostError{host: host, reason: "resolves to a private ip"}
+	}
+	return nil
+}
+
+// matchHost reports whether host is one of hosts or a subdomain of them.
+func matchHost(host string, hosts []string) bool {
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+)
+
+// prioritySem is a semaphore that gives free slots to the waiters with the highest
+// priority first and to the ones with the same priority in arrival order.
+type prioritySem struct {
+	free    int
+	seq     uint64
+	waiters semWaiters
+	m       sync.Mutex
+}
+
+type semWaiter struct {
+	priority int
+	seq      uint64
+	readyC   chan struct{}
+	index    int
+}
+
+func newPrioritySem(n int) *prioritySem {
+	return &prioritySem{free: n}
+}
+
+// acquire waits for a free slot until ctx is done.
+func (s *prioritySem) acquire(ctx context.Context, priority int) error {
+	s.m.Lock()
+	if s.free > 0 && len(s.waiters) == 0 {
+		s.free--
+		s.m.Unlock()
+		return nil
+	}
+	w := &semWaiter{priority: priority, seq: s.seq, readyC: make(chan struct{})}
+	s.seq++
+	heap.Push(&s.waiters, w)
+	s.m.Unlock()
+
+	select {
+	case <-w.readyC:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.m.Lock()
+	select {
+	case <-w.readyC:
+		// the slot is given while canceling, pass it to the next waiter.
+		s.m.Unlock()
+		s.release()
+	default:
+		heap.Remove(&s.waiters, w.index)
+		s.m.Unlock()
+	}
+	return ctx.Err()
+}
+
+// release frees a slot taken by acquire.
+func (s *prioritySem) release() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if len(s.waiters) == 0 {
+		s.free++
+		return
+	}
+	close(heap.Pop(&s.waiters).(*semWaiter).readyC)
+}
+
+// waiting returns the number of waiters.
+func (s *prioritySem) waiting() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.waiters)
+}
+
+// semWaiters is a heap of waiters ordered by priority and arrival.
+type semWaiters []*semWaiter
+
+func (h semWaiters) Len() int { return len(h) }
+
+func (h semWaiters) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h semWaiters) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *semWaiters) Push(x interface{}) {
+	w := x.(*semWaiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *semWaiters) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return w
+}
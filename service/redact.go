@@ -0,0 +1,24 @@
+package service
+
+import "strings"
+
+// redact removes the field at dot separated path from body.
+// Path is applied to each element of the arrays on its way and missing fields are ignored.
+func redact(body interface{}, path string) {
+	redactPath(body, strings.Split(path, "."))
+}
+
+func redactPath(value interface{}, keys []string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(keys) == 1 {
+			delete(v, keys[0])
+			return
+		}
+		redactPath(v[keys[0]], keys[1:])
+	case []interface{}:
+		for _, item := range v {
+			redactPath(item, keys)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// responseCache caches the successful responses of GET requests up to a max number
+// of entries and ttl by evicting the least recently used ones.
+type responseCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	ll    *list.List
+	items map[string]*list.Element
+	m     sync.Mutex
+}
+
+type responseCacheEntry struct {
+	key       string
+	resp      response
+	expiresAt time.Time
+}
+
+func newResponseCache(ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+// responseCacheKey returns the cache key of hreq from the fields that change its response.
+func responseCacheKey(hreq httpRequest) (string, error) {
+	hreq.Timeout = 0
+	hreq.Priority = 0
+	data, err := json.Marshal(hreq)
+	return string(data), err
+}
+
+// get returns the cached response of key if it's not expired.
+func (c *responseCache) get(key string) (response, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return response{}, false
+	}
+	entry := e.Value.(*responseCacheEntry)
+	if !time.Now().Before(entry.expiresAt) {
+		c.remove(e)
+		return response{}, false
+	}
+	c.ll.MoveToFront(e)
+	return entry.resp, true
+}
+
+// set caches resp for key.
+func (c *responseCache) set(key string, resp response) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	c.items[key] = c.ll.PushFront(&responseCacheEntry{
+		key:       key,
+		resp:      resp,
+		expiresAt: time.Now().Add(c.ttl),
+	})
+	for c.ll.Len() > c.maxEntries {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *responseCache) remove(e *list.Element) {
+	c.ll.Remove(e)
+	delete(c.items, e.Value.(*responseCacheEntry).key)
+}
@@ -0,0 +1,30 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/ilgooz/service-webman/webman"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// validateWebhookBody validates decoded webhook body against the webhook schema.
+func (s *Service) validateWebhookBody(body interface{}) error {
+	result, err := s.webhookSchema.Validate(gojsonschema.NewGoLoader(body))
+	if err != nil {
+		return err
+	}
+	if result.Valid() {
+		return nil
+	}
+	var messages []string
+	for _, e := range result.Errors() {
+		messages = append(messages, e.String())
+	}
+	return &webman.StatusError{
+		Code: http.StatusBadRequest,
+		Err: &webman.ValidationError{
+			Message:  "body doesn't match the schema",
+			Messages: messages,
+		},
+	}
+}
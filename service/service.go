@@ -2,18 +2,37 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	mesg "github.com/ilgooz/mesg-go"
 	"github.com/ilgooz/service-webman/webman"
+	uuid "github.com/satori/go.uuid"
+	"github.com/xeipuuv/gojsonschema"
 )
 
+// HTTPDoer performs the upstream requests of tasks.
+// Requests carry the method, headers and body built from the task inputs and
+// ctx carries the deadlines of the task.
+type HTTPDoer interface {
+	Do(ctx context.Context, req *webman.Request) (*webman.Response, error)
+}
+
+// Application performs upstream requests and serves the webhook.
 type Application interface {
-	Post(url string, data, out interface{}) (statusCode int, err error)
+	HTTPDoer
 	StartWebhook(endpoint, addr string, h func(*http.Request) error) error
 	ShutdownWebhook()
 }
@@ -23,38 +42,307 @@ type Service struct {
 	mesgService *mesg.Service
 	webman      Application
 
+	// doer performs upstream requests, it's webman unless it's set.
+	doer HTTPDoer
+
 	log       *log.Logger
 	logOutput io.Writer
 
 	errC chan error
 
+	// closeC closed when the service is closing.
+	closeC    chan struct{}
+	closeOnce sync.Once
+
+	// inflight tracks task handlers that are still running.
+	// inflightM guards adding to inflight against closing.
+	inflight        sync.WaitGroup
+	inflightM       sync.Mutex
+	shutdownTimeout time.Duration
+
 	webhookEndpoint string
 	webhookAddr     string
+	webhookTLS      bool
+	webhookDisabled bool
+	tasksDisabled   bool
+
+	executeEnabled bool
+	batchEnabled   bool
+	healthEnabled  bool
+
+	// shutdownToken enables the shutdown task that closes the service
+	// for the requests with the token.
+	shutdownToken string
+
+	// startedAt is the time when service started.
+	startedAt time.Time
+
+	// version of the service that's sent with lifecycle events.
+	version string
+
+	// lifecycleEvents emits events when the service starts and stops.
+	lifecycleEvents bool
+
+	stats stats
+
+	// emitFailing is set while emitting events to MESG fails.
+	emitFailing int32
+
+	keys keys
+
+	eventKey      string
+	errorEventKey string
+
+	// newID generates ids for webhook events.
+	newID func() string
+
+	// now returns the current time for webhook events.
+	now func() time.Time
+
+	// emitAttempts is the max number of attempts to emit webhook events with
+	// a doubling delay between each, zero means single attempt without a failure response.
+	emitAttempts int
+	emitDelay    time.Duration
+
+	// webhookSyncEmit replies webhook requests with the emit outcome.
+	webhookSyncEmit bool
+
+	// emitBatcher coalesces webhook events into batch events when set.
+	emitBatcher         *emitBatcher
+	emitBatchMaxItems   int
+	emitBatchFlushEvery time.Duration
+
+	// eventBuffer keeps webhook events that couldn't be emitted to emit them later.
+	eventBuffer           *eventBuffer
+	eventBufferDir        string
+	eventBufferMaxEntries int
+	eventBufferFlushEvery time.Duration
+
+	dedupHeader string
+	dedup       *dedupCache
+
+	// timestampHeader carries the sending time of webhook requests that should be
+	// within the timestampTolerance to be accepted.
+	timestampHeader    string
+	timestampTolerance time.Duration
+
+	// localEvents receives a copy of webhook events for in-process consumers when set.
+	localEvents        chan Event
+	droppedLocalEvents int64
+
+	// webhookSequence sets increasing sequence numbers to webhook events.
+	webhookSequence bool
+	sequence        int64
+
+	// debugEvents keeps the last webhook events to serve them for debugging when set.
+	debugEvents *eventRing
+
+	// webhookHeaders is the allowlist of headers that included in webhook events.
+	webhookHeaders []string
+
+	// webhookSchema validates webhook bodies when set.
+	webhookSchema      *gojsonschema.Schema
+	webhookSchemaBytes []byte
+
+	// tenantHeader carries the tenant of webhook requests whose events emitted with
+	// the tenantPrefix + tenant key.
+	tenantHeader string
+	tenantPrefix string
+
+	// routeKeys maps webhook path prefixes to the keys of events emitted for them.
+	routeKeys map[string]string
+
+	// hostKeys maps webhook request hosts to the keys of events emitted for them.
+	hostKeys map[string]string
+
+	// methodEventKeys appends the methods of webhook requests to their event keys.
+	methodEventKeys bool
+
+	// webhookTransform modifies webhook events before they're emitted when set.
+	webhookTransform func(*http.Request, *Event) error
+
+	// eventFields customizes the json keys of webhook events.
+	eventFields eventFields
+
+	// redactPaths are the dot separated paths of fields removed from webhook bodies.
+	redactPaths []string
+
+	// webhookFanOut emits an event per element when webhook body is an array.
+	webhookFanOut bool
+
+	// webhookDecoder decodes webhook request bodies.
+	webhookDecoder func(io.Reader) (interface{}, error)
+
+	// webhookJSON configures the json decoding of webhook request bodies
+	// when there is no webhookDecoder.
+	webhookJSON jsonDecoding
+
+	// webhookEmptyBody accepts webhook requests with empty bodies and emits them
+	// with webhookDefaultBody.
+	webhookEmptyBody   bool
+	webhookDefaultBody interface{}
+
+	// webhookContentTypes are the accepted content types of webhook requests
+	// in addition to json.
+	webhookContentTypes map[string]bool
+
+	// webhookSem limits concurrent webhook handler executions when set.
+	webhookSem     chan struct{}
+	webhookSemWait time.Duration
+
+	// webmanOptions are used while creating the default webman application.
+	webmanOptions []webman.Option
+
+	// dryRun skips the upstream requests of tasks and replies them with their bodies.
+	dryRun bool
+
+	// statusLine replies the status lines and protocols of upstream responses.
+	statusLine bool
+
+	// reconnect makes task listening restart with a jittered reconnectBackoff
+	// when the task stream fails instead of failing the service.
+	reconnect        bool
+	reconnectBackoff time.Duration
+
+	// newMesgService creates a new MESG service to listen tasks on reconnections.
+	newMesgService func() (*mesg.Service, error)
+
+	// listenService is the MESG service created by the current reconnection to listen tasks.
+	listenService *mesg.Service
+	listenM       sync.Mutex
+
+	// upstreamSem limits concurrent upstream requests of all tasks when set.
+	upstreamSem *prioritySem
+
+	// batchDeadline is the max duration of batches, zero means no limit.
+	batchDeadline time.Duration
+
+	// maxBatchSize is the max number of requests accepted in a batch, zero means no limit.
+	maxBatchSize int
+
+	// validateURLs rejects the requests with invalid urls before sending them.
+	validateURLs bool
+
+	// responseCache caches the responses of GET requests when set.
+	responseCache *responseCache
+
+	// hosts restricts the hosts of upstream requests.
+	hosts hostPolicy
 }
 
 // New creates a Service with given options.
 func New(options ...Option) (*Service, error) {
 	s := &Service{
-		logOutput: os.Stdout,
-		errC:      make(chan error, 0),
+		logOutput:       os.Stdout,
+		errC:            make(chan error, 0),
+		closeC:          make(chan struct{}),
+		shutdownTimeout: time.Second * 10,
+		eventKey:        "onRequest",
+		errorEventKey:   "onError",
+		version:         "dev",
+		newID:           func() string { return uuid.NewV4().String() },
+		now:             time.Now,
+		newMesgService: func() (*mesg.Service, error) {
+			return mesg.NewService()
+		},
+		executeEnabled: true,
+		batchEnabled:   true,
+
+		eventBufferFlushEvery: time.Second,
+		webhookContentTypes: map[string]bool{
+			contentTypeJSON: true,
+		},
+		keys: keys{
+			executeTask:   "execute",
+			batchTask:     "batchExecute",
+			successOutput: "success",
+			errorOutput:   "error",
+			batchOutput:   "batch",
+			healthTask:    "health",
+			healthOutput:  "health",
+
+			shutdownTask:   "shutdown",
+			shutdownOutput: "shutdown",
+
+			startEvent: "onStart",
+			stopEvent:  "onStop",
+		},
 	}
 	for _, option := range options {
 		option(s)
 	}
 	s.log = log.New(s.logOutput, "service-webman: ", log.LstdFlags)
 
-	if s.webhookAddr == "" || s.webhookEndpoint == "" {
+	webhookConfigured := s.webhookAddr != "" && s.webhookEndpoint != ""
+	if s.webhookDisabled && webhookConfigured {
+		return nil, errors.New("webhook configurations set while webhook is disabled")
+	}
+	if !s.webhookDisabled && !webhookConfigured {
 		return nil, errors.New("webhook configurations not set")
 	}
+	if s.webhookDisabled && s.tasksDisabled {
+		return nil, errors.New("both webhook and tasks are disabled")
+	}
+	if !s.tasksDisabled && len(s.tasks()) == 0 {
+		return nil, errors.New("no tasks enabled")
+	}
+	if s.reconnect && s.reconnectBackoff <= 0 {
+		return nil, errors.New("reconnect backoff must be positive")
+	}
+
+	for contentType := range s.webhookContentTypes {
+		if _, ok := bodyDecoders[contentType]; !ok && contentType != contentTypeJSON {
+			return nil, fmt.Errorf("content type %q is not supported", contentType)
+		}
+	}
+
+	if s.dedupHeader != "" {
+		s.dedup = newDedupCache(dedupTTL, dedupMaxEntries)
+	}
+
+	if s.emitBatchMaxItems > 0 {
+		s.emitBatcher = newEmitBatcher(s.emitBatchMaxItems, s.emitBatchFlushEvery,
+			func(key string, batch emitBatch) error {
+				return s.emitWithRetry(key+emitBatchKeySuffix, batch)
+			})
+	}
 
 	var err error
 
+	if s.webhookSchemaBytes != nil {
+		s.webhookSchema, err = gojsonschema.NewSchema(gojsonschema.NewBytesLoader(s.webhookSchemaBytes))
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook schema: %s", err)
+		}
+	}
+
+	if s.eventBufferDir != "" {
+		if s.eventBufferMaxEntries <= 0 {
+			return nil, errors.New("event buffer size must be positive")
+		}
+		s.eventBuffer, err = newEventBuffer(s.eventBufferDir, s.eventBufferMaxEntries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.hosts.enabled() {
+		s.webmanOptions = append(s.webmanOptions,
+			webman.CheckRedirectOption(s.hosts.checkRedirect),
+			webman.DialControlOption(s.hosts.dialControl),
+		)
+	}
+
 	if s.webman == nil {
-		s.webman, err = webman.New(webman.LoggerOption(s.log))
+		options := append([]webman.Option{webman.LoggerOption(s.log)}, s.webmanOptions...)
+		s.webman, err = webman.New(options...)
 		if err != nil {
 			return nil, err
 		}
 	}
+	if s.doer == nil {
+		s.doer = s.webman
+	}
 
 	if s.mesgService == nil {
 		s.mesgService, err = mesg.GetService()
@@ -62,6 +350,30 @@ func New(options ...Option) (*Service, error) {
 	return s, err
 }
 
+const (
+	dedupTTL        = time.Minute * 10
+	dedupMaxEntries = 10000
+)
+
+// keys are the task and output keys used to communicate with mesg.
+type keys struct {
+	executeTask string
+	batchTask   string
+	healthTask  string
+
+	successOutput string
+	errorOutput   string
+	batchOutput   string
+	healthOutput  string
+
+	shutdownTask   string
+	shutdownOutput string
+
+	// lifecycle events.
+	startEvent string
+	stopEvent  string
+}
+
 // Option is the configuration function for Service.
 type Option func(*Service)
 
@@ -73,6 +385,631 @@ func WebhookOption(endpoint, addr string) Option {
 	}
 }
 
+// EventKeyOption sets the event key used while emitting webhook events.
+func EventKeyOption(key string) Option {
+	return func(s *Service) {
+		s.eventKey = key
+	}
+}
+
+// ErrorEventKeyOption sets the event key used while emitting failed upstream request events.
+func ErrorEventKeyOption(key string) Option {
+	return func(s *Service) {
+		s.errorEventKey = key
+	}
+}
+
+// WebhookDedupHeaderOption enables deduplication of webhook requests by the id in header.
+// Requests with recently seen ids are accepted without emitting an event.
+func WebhookDedupHeaderOption(header string) Option {
+	return func(s *Service) {
+		s.dedupHeader = header
+	}
+}
+
+// WebhookTimestampOption rejects webhook requests with 400 when the time in header isn't
+// within tolerance of now to prevent replays. Header value is a unix timestamp in seconds
+// or a RFC 3339 date.
+func WebhookTimestampOption(header string, tolerance time.Duration) Option {
+	return func(s *Service) {
+		s.timestampHeader = header
+		s.timestampTolerance = tolerance
+	}
+}
+
+// WebhookHeadersOption includes given request headers in webhook events.
+// Headers that are not listed never leave the service.
+func WebhookHeadersOption(headers ...string) Option {
+	return func(s *Service) {
+		s.webhookHeaders = append(s.webhookHeaders, headers...)
+	}
+}
+
+// WebhookSchemaOption validates webhook bodies against the json schema.
+// Requests with bodies that don't match the schema are replied with 400 and no events emitted for them.
+func WebhookSchemaOption(schema []byte) Option {
+	return func(s *Service) {
+		s.webhookSchemaBytes = schema
+	}
+}
+
+// LocalEventsOption sends a copy of every webhook event to the channel returned by Events
+// with a buffer size. Events are dropped when the buffer is full.
+func LocalEventsOption(buffer int) Option {
+	return func(s *Service) {
+		s.localEvents = make(chan Event, buffer)
+	}
+}
+
+// EmitBatchOption coalesces the webhook events of the same keys into batch events with
+// up to maxItems events that are emitted when they're full or flushInterval after their
+// first events. Batches are emitted with the keys of their events suffixed with "Batch"
+// like onRequestBatch. Webhook requests are replied before their events are emitted.
+func EmitBatchOption(maxItems int, flushInterval time.Duration) Option {
+	return func(s *Service) {
+		s.emitBatchMaxItems = maxItems
+		s.emitBatchFlushEvery = flushInterval
+	}
+}
+
+// LifecycleEventsOption sets whether onStart and onStop events are emitted with
+// the version and uptime of the service when it starts and after it's closed.
+func LifecycleEventsOption(enabled bool) Option {
+	return func(s *Service) {
+		s.lifecycleEvents = enabled
+	}
+}
+
+// VersionOption sets the version of the service sent with lifecycle events, it's dev by default.
+func VersionOption(version string) Option {
+	return func(s *Service) {
+		s.version = version
+	}
+}
+
+// WebhookSequenceOption sets whether webhook events have sequence numbers that
+// increase by one for each emitted event so consumers can order them.
+func WebhookSequenceOption(enabled bool) Option {
+	return func(s *Service) {
+		s.webhookSequence = enabled
+	}
+}
+
+// WebhookDebugBufferOption keeps the last n webhook events in memory and serves them
+// from the oldest to the most recent as json for GET requests to path of the webhook server.
+func WebhookDebugBufferOption(path string, n int) Option {
+	return func(s *Service) {
+		if n <= 0 {
+			return
+		}
+		s.debugEvents = newEventRing(n)
+		s.webmanOptions = append(s.webmanOptions,
+			webman.WebhookMiddlewareOption(debugEventsMiddleware(path, s.debugEvents)))
+	}
+}
+
+// WebhookTransformOption runs transform for each webhook event before it's emitted
+// to modify or enrich it, e.g. by setting fields of its Body. Requests are replied with 400
+// and no events emitted for them when transform returns an error.
+func WebhookTransformOption(transform func(*http.Request, *Event) error) Option {
+	return func(s *Service) {
+		s.webhookTransform = transform
+	}
+}
+
+// WebhookTenantHeaderOption emits webhook events with prefix + tenant key where tenant
+// is read from header. Events of requests without the header are emitted with the event key.
+func WebhookTenantHeaderOption(header, prefix string) Option {
+	return func(s *Service) {
+		s.tenantHeader = header
+		s.tenantPrefix = prefix
+	}
+}
+
+// WebhookBodyKeyOption sets the json key of webhook event bodies, it's "body" by default.
+func WebhookBodyKeyOption(key string) Option {
+	return func(s *Service) {
+		s.eventFields.body = key
+	}
+}
+
+// WebhookDateKeyOption sets the json key of webhook event dates, it's "date" by default.
+func WebhookDateKeyOption(key string) Option {
+	return func(s *Service) {
+		s.eventFields.date = key
+	}
+}
+
+// WebhookIDKeyOption sets the json key of webhook event ids, it's "id" by default.
+func WebhookIDKeyOption(key string) Option {
+	return func(s *Service) {
+		s.eventFields.id = key
+	}
+}
+
+// WebhookRedactOption removes the fields at dot separated paths like "card.number"
+// from webhook bodies before they're emitted, including the injected ones.
+// Missing fields are ignored.
+func WebhookRedactOption(paths []string) Option {
+	return func(s *Service) {
+		s.redactPaths = append(s.redactPaths, paths...)
+	}
+}
+
+// WebhookRouteKeyOption makes webhook accept requests to the path prefixes of routes
+// and emit their events with the mapped event keys. The longest matching prefix is used.
+func WebhookRouteKeyOption(routes map[string]string) Option {
+	return func(s *Service) {
+		if s.routeKeys == nil {
+			s.routeKeys = map[string]string{}
+		}
+		var prefixes []string
+		for prefix, key := range routes {
+			s.routeKeys[prefix] = key
+			prefixes = append(prefixes, prefix)
+		}
+		s.webmanOptions = append(s.webmanOptions, webman.WebhookPathPrefixesOption(prefixes...))
+	}
+}
+
+// WebhookMethodsOption makes webhook accept requests with methods instead of only POST.
+// Events of requests other than POST that don't have a body are emitted without a body.
+func WebhookMethodsOption(methods ...string) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.WebhookMethodsOption(methods...))
+	}
+}
+
+// WebhookMethodEventKeysOption sets whether the http method of webhook requests is appended
+// to their event keys like onRequest.GET. It's applied to the keys of all the other key options.
+func WebhookMethodEventKeysOption(enabled bool) Option {
+	return func(s *Service) {
+		s.methodEventKeys = enabled
+	}
+}
+
+// WebhookHostKeyOption emits the events of webhook requests sent to the hosts of routes
+// with the mapped event keys. Path routes of WebhookRouteKeyOption take precedence.
+func WebhookHostKeyOption(routes map[string]string) Option {
+	return func(s *Service) {
+		if s.hostKeys == nil {
+			s.hostKeys = map[string]string{}
+		}
+		for host, key := range routes {
+			s.hostKeys[strings.ToLower(host)] = key
+		}
+	}
+}
+
+// WebhookFanOutOption makes webhook emit a separate event for each element
+// when the request body is an array. Each event gets its own id.
+func WebhookFanOutOption(enabled bool) Option {
+	return func(s *Service) {
+		s.webhookFanOut = enabled
+	}
+}
+
+// ReconnectOption makes service reconnect to MESG with a jittered backoff when
+// the task stream fails instead of stopping. backoff must be positive when it's enabled.
+func ReconnectOption(enabled bool, backoff time.Duration) Option {
+	return func(s *Service) {
+		s.reconnect = enabled
+		s.reconnectBackoff = backoff
+	}
+}
+
+// GlobalConcurrencyOption limits the number of concurrent upstream requests
+// across all execute and batchExecute tasks to n. Zero means no limit.
+// Waiting requests are sent by their priorities.
+func GlobalConcurrencyOption(n int) Option {
+	return func(s *Service) {
+		s.upstreamSem = nil
+		if n > 0 {
+			s.upstreamSem = newPrioritySem(n)
+		}
+	}
+}
+
+// BatchDeadlineOption limits the total duration of batches. Requests still running
+// at the deadline are canceled and reported as errors.
+func BatchDeadlineOption(d time.Duration) Option {
+	return func(s *Service) {
+		s.batchDeadline = d
+	}
+}
+
+// StatusLineOption sets whether the status line like "200 OK" and the protocol
+// like "HTTP/1.1" of upstream responses are replied along with their status codes.
+func StatusLineOption(enabled bool) Option {
+	return func(s *Service) {
+		s.statusLine = enabled
+	}
+}
+
+// DryRunOption makes tasks skip the upstream requests and reply a 200 response
+// that echoes the request body. It can be used to test workflows safely.
+func DryRunOption(enabled bool) Option {
+	return func(s *Service) {
+		s.dryRun = enabled
+	}
+}
+
+// WebhookContentTypesOption accepts webhook requests with given content types.
+// Supported types are application/json, application/x-www-form-urlencoded and text/plain.
+// Requests with other content types are decoded as json.
+func WebhookContentTypesOption(contentTypes ...string) Option {
+	return func(s *Service) {
+		for _, contentType := range contentTypes {
+			s.webhookContentTypes[contentType] = true
+		}
+	}
+}
+
+// WebhookConcurrencyOption limits the number of webhook requests handled concurrently to n.
+// Requests wait up to wait for a free slot and they're replied with 429 afterwards.
+// Zero means no limit.
+func WebhookConcurrencyOption(n int, wait time.Duration) Option {
+	return func(s *Service) {
+		s.webhookSem = nil
+		if n > 0 {
+			s.webhookSem = make(chan struct{}, n)
+		}
+		s.webhookSemWait = wait
+	}
+}
+
+// WebhookRateLimitOption limits webhook requests to requestsPerSecond with burst.
+// burst must be at least 1.
+func WebhookRateLimitOption(requestsPerSecond float64, burst int) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.WebhookRateLimitOption(requestsPerSecond, burst))
+	}
+}
+
+// WebhookTLSOption serves the webhook server with tls by using the certificate in certFile
+// and the private key in keyFile.
+func WebhookTLSOption(certFile, keyFile string) Option {
+	return func(s *Service) {
+		s.webhookTLS = true
+		s.webmanOptions = append(s.webmanOptions, webman.WebhookTLSOption(certFile, keyFile))
+	}
+}
+
+// HTTP2Option sets whether HTTP/2 is negotiated with upstreams over tls and advertised
+// by the tls webhook server. It's enabled by default.
+func HTTP2Option(enabled bool) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.HTTP2Option(enabled))
+	}
+}
+
+// WebhookMaxHeaderBytesOption limits the size of webhook request headers to n bytes,
+// requests with larger headers are rejected with 431.
+func WebhookMaxHeaderBytesOption(n int) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.WebhookMaxHeaderBytesOption(n))
+	}
+}
+
+// RetryBudgetOption limits the retries of all upstream requests to maxRetriesPerSecond
+// so the requests of batches to a degraded upstream don't multiply the load with retries.
+func RetryBudgetOption(maxRetriesPerSecond float64) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.RetryBudgetOption(maxRetriesPerSecond))
+	}
+}
+
+// RequestRetryOption retries upstream requests that fail with a connection error, 429 or 503
+// up to attempts times, honoring their Retry-After headers capped to maxDelay or to 30s when it's zero.
+// POST requests are retried on connection errors only when they fail to connect.
+func RequestRetryOption(attempts int, delay, maxDelay time.Duration) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.RetryOption(attempts, delay, maxDelay))
+	}
+}
+
+// MaxConnsPerHostOption limits the connections to each upstream host to n so large batches
+// don't open a connection per request. Requests wait for a free connection within their timeout.
+func MaxConnsPerHostOption(n int) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.MaxConnsPerHostOption(n))
+	}
+}
+
+// ValidateURLsOption sets whether the urls of upstream requests are validated to be
+// absolute http or https urls before they're sent. Requests with invalid urls are replied
+// with errors that describe their problems. Valid urls are sent with their surrounding
+// spaces trimmed and their schemes and hosts lower cased.
+func ValidateURLsOption(enabled bool) Option {
+	return func(s *Service) {
+		s.validateURLs = enabled
+	}
+}
+
+// ResponseCacheOption caches the successful responses of GET requests of tasks for ttl
+// up to maxEntries by evicting the least recently used ones. Requests with the same
+// url, headers and options are replied with the cached responses without being sent.
+func ResponseCacheOption(ttl time.Duration, maxEntries int) Option {
+	return func(s *Service) {
+		s.responseCache = newResponseCache(ttl, maxEntries)
+	}
+}
+
+// ClientCertOption sends the certificate in certFile with the private key in keyFile
+// to upstreams that require client certificates for mutual tls.
+func ClientCertOption(certFile, keyFile string) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.ClientCertOption(certFile, keyFile))
+	}
+}
+
+// ClientCertPEMOption is like ClientCertOption but with pem encoded certificate and key.
+func ClientCertPEMOption(certPEM, keyPEM []byte) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.ClientCertPEMOption(certPEM, keyPEM))
+	}
+}
+
+// MaxResponseBytesOption limits the size of upstream response bodies to n bytes.
+// Requests can override it with their own limits.
+func MaxResponseBytesOption(n int64) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.MaxResponseBytesOption(n))
+	}
+}
+
+// DebugBodyLogOption sets whether the bodies of upstream requests and responses are logged
+// for debugging with the values of json keys in redactKeys masked. It's disabled by default.
+func DebugBodyLogOption(enabled bool, redactKeys []string) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.DebugBodyLogOption(enabled, redactKeys))
+	}
+}
+
+// KeepAliveOption sets the period of tcp keep-alive probes of upstream connections.
+// Negative d disables keep-alives.
+func KeepAliveOption(d time.Duration) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.KeepAliveOption(d))
+	}
+}
+
+// DNSCacheOption caches the resolved ips of upstream hosts for ttl so batches to the
+// same hosts don't look them up for each new connection.
+func DNSCacheOption(ttl time.Duration) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.DNSCacheOption(ttl))
+	}
+}
+
+// DialTimeoutOption limits the time to connect to upstreams independently from the request timeout.
+func DialTimeoutOption(d time.Duration) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.DialTimeoutOption(d))
+	}
+}
+
+// HTTPDoerOption performs upstream requests of tasks with doer instead of webman.
+// Options of upstream requests like DefaultHeadersOption are not applied to them.
+func HTTPDoerOption(doer HTTPDoer) Option {
+	return func(s *Service) {
+		s.doer = doer
+	}
+}
+
+// AllowedHostsOption only allows upstream requests to hosts and their subdomains.
+// Requests to other hosts are replied with errors without being sent and
+// redirects to them aren't followed.
+func AllowedHostsOption(hosts []string) Option {
+	return func(s *Service) {
+		s.hosts.allowed = hosts
+	}
+}
+
+// DeniedHostsOption denies upstream requests to hosts and their subdomains.
+// Requests to them are replied with errors without being sent and redirects to them
+// aren't followed. Denied ips are also checked against the ips that hosts resolve to
+// while connecting. Denied hosts take precedence over the allowed ones.
+func DeniedHostsOption(hosts []string) Option {
+	return func(s *Service) {
+		s.hosts.denied = hosts
+	}
+}
+
+// BlockPrivateIPsOption sets whether upstream requests to hosts that are or resolve to
+// loopback, link-local and private ips are replied with errors without being sent.
+// Resolved ips are checked while connecting so they can't change after they're checked.
+// Only the hosts of requests are checked when the webman application or the doer
+// of the service is replaced.
+func BlockPrivateIPsOption(block bool) Option {
+	return func(s *Service) {
+		s.hosts.blockPrivateIPs = block
+	}
+}
+
+// DefaultHeadersOption sets headers to all upstream requests.
+// Headers of task inputs override them.
+func DefaultHeadersOption(headers map[string]string) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.DefaultHeadersOption(headers))
+	}
+}
+
+// BufferPoolOption sets whether upstream request bodies are marshaled into reused buffers.
+func BufferPoolOption(enabled bool) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.BufferPoolOption(enabled))
+	}
+}
+
+// ETagCacheOption caches responses of GET requests with ETags up to maxEntries urls
+// and revalidates them with If-None-Match.
+func ETagCacheOption(maxEntries int) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.ETagCacheOption(maxEntries))
+	}
+}
+
+// WebhookMiddlewareOption wraps webhook handler with mw.
+func WebhookMiddlewareOption(mw ...func(http.Handler) http.Handler) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.WebhookMiddlewareOption(mw...))
+	}
+}
+
+// WebhookRequestIDHeaderOption reads request ids of webhook requests from header
+// to use them as event ids. Ids are generated for requests without one and echoed back in header.
+func WebhookRequestIDHeaderOption(header string) Option {
+	return func(s *Service) {
+		s.webmanOptions = append(s.webmanOptions, webman.WebhookRequestIDHeaderOption(header))
+	}
+}
+
+// DisableWebhookOption runs the service without a webhook server to only handle tasks.
+func DisableWebhookOption() Option {
+	return func(s *Service) {
+		s.webhookDisabled = true
+	}
+}
+
+// DisableTasksOption runs the service without listening tasks to only emit webhook events.
+func DisableTasksOption() Option {
+	return func(s *Service) {
+		s.tasksDisabled = true
+	}
+}
+
+// WebhookDecoderOption decodes webhook request bodies with decoder instead of json.
+// Decoded value is emitted as the body of webhook events.
+func WebhookDecoderOption(decoder func(io.Reader) (interface{}, error)) Option {
+	return func(s *Service) {
+		s.webhookDecoder = decoder
+	}
+}
+
+// WebhookEmptyBodyOption accepts webhook requests with empty bodies like verification pings
+// instead of replying them with 400 and emits their events with body, which can be nil.
+func WebhookEmptyBodyOption(body interface{}) Option {
+	return func(s *Service) {
+		s.webhookEmptyBody = true
+		s.webhookDefaultBody = body
+	}
+}
+
+// WebhookUseNumberOption decodes the numbers of json webhook request bodies as
+// json.Number so large integers are emitted without losing precision.
+func WebhookUseNumberOption(useNumber bool) Option {
+	return func(s *Service) {
+		s.webhookJSON.useNumber = useNumber
+	}
+}
+
+// WebhookBodyTypeOption decodes json webhook request bodies into new values of v's type
+// instead of generic maps and lists. Redaction and fan-out don't apply to typed bodies.
+func WebhookBodyTypeOption(v interface{}) Option {
+	return func(s *Service) {
+		s.webhookJSON.bodyType = reflect.TypeOf(v)
+	}
+}
+
+// WebhookDisallowUnknownFieldsOption rejects json webhook request bodies that have
+// fields unknown to the type set by WebhookBodyTypeOption.
+func WebhookDisallowUnknownFieldsOption(disallow bool) Option {
+	return func(s *Service) {
+		s.webhookJSON.disallowUnknownFields = disallow
+	}
+}
+
+// IDGeneratorOption generates webhook event ids with fn instead of UUIDv4.
+func IDGeneratorOption(fn func() string) Option {
+	return func(s *Service) {
+		s.newID = fn
+	}
+}
+
+// ClockOption uses now to get the time of webhook events.
+func ClockOption(now func() time.Time) Option {
+	return func(s *Service) {
+		s.now = now
+	}
+}
+
+// EmitRetryOption retries emitting webhook events up to attempts times by doubling delay.
+// Webhook requests are replied with 503 when all attempts fail so providers can retry.
+func EmitRetryOption(attempts int, delay time.Duration) Option {
+	return func(s *Service) {
+		s.emitAttempts = attempts
+		s.emitDelay = delay
+	}
+}
+
+// WebhookSyncEmitOption sets whether webhook requests are replied with 200 once their
+// events are emitted and with 503 when emitting fails so providers can retry,
+// instead of 202 regardless of the outcome. Buffered events count as emitted.
+func WebhookSyncEmitOption(enabled bool) Option {
+	return func(s *Service) {
+		s.webhookSyncEmit = enabled
+	}
+}
+
+// EventBufferOption buffers webhook events that can't be emitted in dir up to maxEntries.
+// Buffered events are emitted in order once emitting succeeds again,
+// the oldest events are dropped when the buffer is full.
+func EventBufferOption(dir string, maxEntries int) Option {
+	return func(s *Service) {
+		s.eventBufferDir = dir
+		s.eventBufferMaxEntries = maxEntries
+	}
+}
+
+// EnableExecuteOption sets whether execute task is registered, it's enabled by default.
+func EnableExecuteOption(enabled bool) Option {
+	return func(s *Service) {
+		s.executeEnabled = enabled
+	}
+}
+
+// EnableBatchOption sets whether batchExecute task is registered, it's enabled by default.
+func EnableBatchOption(enabled bool) Option {
+	return func(s *Service) {
+		s.batchEnabled = enabled
+	}
+}
+
+// HealthTaskOption enables the health task that reports the uptime of service and
+// whether the webhook server and MESG connection are working.
+func HealthTaskOption() Option {
+	return func(s *Service) {
+		s.healthEnabled = true
+	}
+}
+
+// ShutdownTaskOption enables the shutdown task that gracefully closes the service
+// after replying. Only the requests with token can shut down the service,
+// the task is not enabled when token is empty.
+func ShutdownTaskOption(token string) Option {
+	return func(s *Service) {
+		s.shutdownToken = token
+	}
+}
+
+// TaskKeysOption sets the task keys of execute and batchExecute tasks.
+func TaskKeysOption(execute, batch string) Option {
+	return func(s *Service) {
+		s.keys.executeTask = execute
+		s.keys.batchTask = batch
+	}
+}
+
+// OutputKeysOption sets the output keys used while replying tasks.
+func OutputKeysOption(successKey, errorKey, batchKey string) Option {
+	return func(s *Service) {
+		s.keys.successOutput = successKey
+		s.keys.errorOutput = errorKey
+		s.keys.batchOutput = batchKey
+	}
+}
+
 // LogOutputOption uses out as a log destination.
 func LogOutputOption(out io.Writer) Option {
 	return func(s *Service) {
@@ -80,45 +1017,294 @@ func LogOutputOption(out io.Writer) Option {
 	}
 }
 
+// MaxBatchSizeOption limits the number of requests accepted in a batch.
+func MaxBatchSizeOption(n int) Option {
+	return func(s *Service) {
+		s.maxBatchSize = n
+	}
+}
+
+// ShutdownTimeoutOption sets the maximum duration to wait for in-flight tasks while closing.
+func ShutdownTimeoutOption(d time.Duration) Option {
+	return func(s *Service) {
+		s.shutdownTimeout = d
+	}
+}
+
 func mesgServiceOption(service *mesg.Service) Option {
 	return func(s *Service) {
 		s.mesgService = service
 	}
 }
 
+func mesgServiceFactoryOption(newService func() (*mesg.Service, error)) Option {
+	return func(s *Service) {
+		s.newMesgService = newService
+	}
+}
+
+func eventBufferFlushIntervalOption(d time.Duration) Option {
+	return func(s *Service) {
+		s.eventBufferFlushEvery = d
+	}
+}
+
 func applicationServiceOption(app Application) Option {
 	return func(s *Service) {
 		s.webman = app
 	}
 }
 
-// Start starts the service and blocks untill there is an error.
+// Start starts the service and blocks untill there is an error or the service is closed.
+// It returns nil when the service is closed with Close.
 func (s *Service) Start() error {
-	go s.listenTasks()
-	go s.startWebhook()
-	err := <-s.errC
-	s.Close()
-	return err
+	s.startedAt = s.now()
+	if !s.tasksDisabled {
+		go s.listenTasks()
+	}
+	if !s.webhookDisabled {
+		go s.startWebhook()
+	}
+	if s.eventBuffer != nil {
+		go s.flushEventBuffer()
+	}
+	if s.lifecycleEvents {
+		s.emitLifecycleEvent(s.keys.startEvent)
+	}
+	select {
+	case err := <-s.errC:
+		s.Close()
+		return err
+	case <-s.closeC:
+		return nil
+	}
+}
+
+// flushEventBuffer periodically emits buffered events until the service is closed.
+func (s *Service) flushEventBuffer() {
+	ticker := time.NewTicker(s.eventBufferFlushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.eventBuffer.flush(s.emitEvent); err != nil {
+				s.log.Printf("error while flushing buffered events: %s", err)
+			}
+		case <-s.closeC:
+			return
+		}
+	}
+}
+
+// fail reports err to Start unless the service is closing.
+// Errors while closing are caused by the shutdown itself so they're ignored.
+func (s *Service) fail(err error) {
+	select {
+	case s.errC <- err:
+	case <-s.closeC:
+	}
 }
 
 func (s *Service) listenTasks() {
-	if err := s.mesgService.ListenTasks(
-		mesg.NewTask("execute", s.executeHandler),
-		mesg.NewTask("batchExecute", s.batchExecuteHandler),
-	); err != nil {
-		s.errC <- err
+	tasks := s.tasks()
+	err := s.mesgService.ListenTasks(tasks[0], tasks[1:]...)
+	if !s.reconnect {
+		if err != nil {
+			s.fail(err)
+		}
+		return
+	}
+
+	// a MESG service can listen tasks once, so a new one created for each reconnection.
+	for {
+		select {
+		case <-s.closeC:
+			return
+		default:
+		}
+		if err != nil {
+			s.log.Printf("error while listening tasks, reconnecting: %s", err)
+		} else {
+			s.log.Printf("task stream is closed, reconnecting")
+		}
+		if !s.waitReconnect() {
+			return
+		}
+		var srv *mesg.Service
+		srv, err = s.newMesgService()
+		if err != nil {
+			continue
+		}
+		if !s.setListenService(srv) {
+			return
+		}
+		err = srv.ListenTasks(tasks[0], tasks[1:]...)
+		s.closeListenService(srv)
+	}
+}
+
+// setListenService sets srv as the current service to listen tasks.
+// It closes srv and returns false when the service is closed meanwhile.
+func (s *Service) setListenService(srv *mesg.Service) bool {
+	s.listenM.Lock()
+	defer s.listenM.Unlock()
+	select {
+	case <-s.closeC:
+		if srv != s.mesgService {
+			srv.Close()
+		}
+		return false
+	default:
+	}
+	s.listenService = srv
+	return true
+}
+
+// closeListenService closes srv unless it's the main MESG service, which is closed by Close.
+// A nil srv closes the current listen service.
+func (s *Service) closeListenService(srv *mesg.Service) {
+	s.listenM.Lock()
+	defer s.listenM.Unlock()
+	if srv == nil {
+		srv = s.listenService
+	}
+	if srv == nil || srv != s.listenService {
+		return
+	}
+	s.listenService = nil
+	if srv != s.mesgService {
+		srv.Close()
+	}
+}
+
+// waitReconnect waits for the jittered reconnect backoff.
+// It returns false when the service is closed meanwhile.
+func (s *Service) waitReconnect() bool {
+	backoff := s.reconnectBackoff + time.Duration(rand.Int63n(int64(s.reconnectBackoff)/2+1))
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.closeC:
+		return false
+	}
+}
+
+// tasks returns the enabled tasks.
+func (s *Service) tasks() []mesg.Task {
+	var tasks []mesg.Task
+	if s.executeEnabled {
+		tasks = append(tasks, mesg.NewTask(s.keys.executeTask, s.track(s.executeHandler)))
+	}
+	if s.batchEnabled {
+		tasks = append(tasks, mesg.NewTask(s.keys.batchTask, s.track(s.batchExecuteHandler)))
+	}
+	if s.healthEnabled {
+		tasks = append(tasks, mesg.NewTask(s.keys.healthTask, s.healthHandler))
+	}
+	if s.shutdownToken != "" {
+		tasks = append(tasks, mesg.NewTask(s.keys.shutdownTask, s.shutdownHandler))
+	}
+	return tasks
+}
+
+// track marks h as in-flight while it runs so Close can wait for it.
+func (s *Service) track(h func(*mesg.Request)) func(*mesg.Request) {
+	return func(req *mesg.Request) {
+		s.inflightM.Lock()
+		select {
+		case <-s.closeC:
+			s.inflightM.Unlock()
+			if err := req.Reply(s.keys.errorOutput, httpErrorResponse{
+				Message: "service is shutting down",
+			}); err != nil {
+				s.log.Printf("error while reply: %s", err)
+			}
+			return
+		default:
+		}
+		s.inflight.Add(1)
+		s.inflightM.Unlock()
+		defer s.inflight.Done()
+		h(req)
 	}
 }
 
 func (s *Service) startWebhook() {
-	if err := s.webman.StartWebhook(s.webhookEndpoint, s.webhookAddr, s.webhookHandler); err != nil {
-		s.errC <- err
+	err := s.webman.StartWebhook(s.webhookEndpoint, s.webhookAddr, s.webhookHandler)
+	if err != nil && err != http.ErrServerClosed {
+		s.fail(err)
 	}
 }
 
 // Close gracefully closes service.
+// It waits for in-flight tasks to reply until the shutdown timeout exceeds.
+// Calling Close more than once is safe.
 func (s *Service) Close() error {
-	s.webman.ShutdownWebhook()
-	s.mesgService.Close()
+	s.closeOnce.Do(func() {
+		s.inflightM.Lock()
+		close(s.closeC)
+		s.inflightM.Unlock()
+		if !s.webhookDisabled {
+			s.webman.ShutdownWebhook()
+		}
+		s.waitInflight()
+		if s.emitBatcher != nil {
+			s.emitBatcher.flush()
+		}
+		if s.lifecycleEvents && !s.startedAt.IsZero() {
+			s.emitLifecycleEvent(s.keys.stopEvent)
+		}
+		s.closeListenService(nil)
+		s.mesgService.Close()
+	})
 	return nil
 }
+
+// InjectWebhook emits a webhook event with body as if it's received by the webhook server.
+// It can be used to replay dropped webhooks.
+func (s *Service) InjectWebhook(body interface{}) error {
+	atomic.AddInt64(&s.stats.webhookRequests, 1)
+
+	// decode body the same way as the webhook server does.
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.webhookEndpoint, nil)
+	if err != nil {
+		return err
+	}
+	return s.handleWebhookBody(req, decoded)
+}
+
+// Events returns the channel that receives webhook events for in-process consumers.
+// It's nil unless LocalEventsOption is used.
+func (s *Service) Events() <-chan Event {
+	return s.localEvents
+}
+
+// DroppedEvents returns the number of webhook events dropped because of
+// the full local events buffer.
+func (s *Service) DroppedEvents() int64 {
+	return atomic.LoadInt64(&s.droppedLocalEvents)
+}
+
+func (s *Service) waitInflight() {
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(s.shutdownTimeout):
+		s.log.Println("shutdown timeout exceeded while waiting for in-flight tasks")
+	}
+}
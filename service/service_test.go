@@ -2,15 +2,29 @@ package service
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	mesg "github.com/ilgooz/mesg-go"
+	"github.com/ilgooz/service-webman/webman"
 	"github.com/mesg-foundation/core/api/service"
 	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
@@ -78,13 +92,1163 @@ func TestOnRequestEvent(t *testing.T) {
 	go tw.webhookHandler(req)
 	ed := <-emitC
 	assert.Equal(t, "onRequest", ed.EventKey)
-	var out webhookResponse
+	var out Event
 	assert.Nil(t, json.Unmarshal([]byte(ed.EventData), &out))
 	assert.Equal(t, data, out.Body)
 	_, err = uuid.FromString(out.ID)
 	assert.NotEmpty(t, out.Date)
 }
 
+func TestOnRequestEventCustomKey(t *testing.T) {
+	eventKey := "onPayment"
+
+	srv, err := mesg.NewService(
+		mesg.ServiceTokenOption(token),
+		mesg.ServiceEndpointOption(endpoint),
+	)
+	assert.Nil(t, err)
+
+	emitC := make(chan *service.EmitEventRequest, 0)
+	srv.Client = &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}
+
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+
+	s, err := New(
+		LogOutputOption(ioutil.Discard),
+		WebhookOption("test", "test"),
+		EventKeyOption(eventKey),
+		mesgServiceOption(srv),
+		applicationServiceOption(tw),
+	)
+	assert.Nil(t, err)
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("", "", bytes.NewBufferString(`{"body":"test"}`))
+	assert.Nil(t, err)
+	go tw.webhookHandler(req)
+	ed := <-emitC
+	assert.Equal(t, eventKey, ed.EventKey)
+}
+
+func TestOnRequestEventDedup(t *testing.T) {
+	srv, err := mesg.NewService(
+		mesg.ServiceTokenOption(token),
+		mesg.ServiceEndpointOption(endpoint),
+	)
+	assert.Nil(t, err)
+
+	emitC := make(chan *service.EmitEventRequest, 2)
+	srv.Client = &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}
+
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+
+	s, err := New(
+		LogOutputOption(ioutil.Discard),
+		WebhookOption("test", "test"),
+		WebhookDedupHeaderOption("X-Delivery-ID"),
+		mesgServiceOption(srv),
+		applicationServiceOption(tw),
+	)
+	assert.Nil(t, err)
+
+	go s.Start()
+	<-tw.startC
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("", "", bytes.NewBufferString(`{"body":"test"}`))
+		assert.Nil(t, err)
+		req.Header.Set("X-Delivery-ID", "1")
+		err = tw.webhookHandler(req)
+		if i == 0 {
+			assert.Nil(t, err)
+		} else {
+			assert.Equal(t, &webman.StatusError{Code: http.StatusOK}, err)
+		}
+	}
+	assert.Equal(t, 1, len(emitC))
+}
+
+func TestOnRequestEventDedupEmitFailure(t *testing.T) {
+	srv, err := mesg.NewService(
+		mesg.ServiceTokenOption(token),
+		mesg.ServiceEndpointOption(endpoint),
+	)
+	assert.Nil(t, err)
+
+	var failing int32 = 1
+	emitC := make(chan *service.EmitEventRequest, 1)
+	srv.Client = &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+		emitErr: func() error {
+			if atomic.LoadInt32(&failing) == 1 {
+				return errors.New("unavailable")
+			}
+			return nil
+		},
+	}
+
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+
+	s, err := New(
+		LogOutputOption(ioutil.Discard),
+		WebhookOption("test", "test"),
+		WebhookDedupHeaderOption("X-Delivery-ID"),
+		EmitRetryOption(1, time.Millisecond),
+		mesgServiceOption(srv),
+		applicationServiceOption(tw),
+	)
+	assert.Nil(t, err)
+
+	go s.Start()
+	<-tw.startC
+
+	deliver := func() error {
+		req, err := http.NewRequest("", "", bytes.NewBufferString(`{"body":"test"}`))
+		assert.Nil(t, err)
+		req.Header.Set("X-Delivery-ID", "1")
+		return tw.webhookHandler(req)
+	}
+
+	err = deliver()
+	assert.Equal(t, http.StatusServiceUnavailable, err.(*webman.StatusError).Code)
+
+	atomic.StoreInt32(&failing, 0)
+	assert.Nil(t, deliver())
+	assert.Equal(t, 1, len(emitC))
+}
+
+func TestOnRequestEventHeaders(t *testing.T) {
+	srv, err := mesg.NewService(
+		mesg.ServiceTokenOption(token),
+		mesg.ServiceEndpointOption(endpoint),
+	)
+	assert.Nil(t, err)
+
+	emitC := make(chan *service.EmitEventRequest, 0)
+	srv.Client = &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}
+
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+
+	s, err := New(
+		LogOutputOption(ioutil.Discard),
+		WebhookOption("test", "test"),
+		WebhookHeadersOption("X-Event-Type"),
+		mesgServiceOption(srv),
+		applicationServiceOption(tw),
+	)
+	assert.Nil(t, err)
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("", "", bytes.NewBufferString(`{"body":"test"}`))
+	assert.Nil(t, err)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Event-Type", "push")
+	req.Header.Set("Authorization", "secret")
+	go tw.webhookHandler(req)
+	ed := <-emitC
+
+	var out Event
+	assert.Nil(t, json.Unmarshal([]byte(ed.EventData), &out))
+	assert.Equal(t, map[string]string{"X-Event-Type": "push"}, out.Headers)
+	assert.Equal(t, "10.0.0.1:1234", out.RemoteAddr)
+}
+
+func TestOnRequestEventFanOut(t *testing.T) {
+	tests := []struct {
+		fanOut bool
+		events int
+	}{
+		{false, 1},
+		{true, 3},
+	}
+	for _, test := range tests {
+		emitC := make(chan *service.EmitEventRequest, 3)
+		tw := &testWebman{startC: make(chan struct{}, 0)}
+		s := newTestService(t, &testClient{
+			emitC:  emitC,
+			stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+		}, tw, WebhookFanOutOption(test.fanOut))
+
+		go s.Start()
+		<-tw.startC
+
+		req, err := http.NewRequest("", "", bytes.NewBufferString(`[{"n":1},{"n":2},{"n":3}]`))
+		assert.Nil(t, err)
+		assert.Nil(t, tw.webhookHandler(req))
+		assert.Equal(t, test.events, len(emitC))
+
+		ids := map[string]bool{}
+		for i := 0; i < test.events; i++ {
+			var out Event
+			assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+			ids[out.ID] = true
+			if test.fanOut {
+				assert.Equal(t, map[string]interface{}{"n": float64(i + 1)}, out.Body)
+			} else {
+				assert.Len(t, out.Body, 3)
+			}
+		}
+		assert.Len(t, ids, test.events)
+		s.Close()
+	}
+}
+
+func TestOnRequestEventSchema(t *testing.T) {
+	schema := []byte(`{"type":"object","required":["event","amount"],"properties":{"event":{"type":"string"}}}`)
+
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookSchemaOption(schema))
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("", "", bytes.NewBufferString(`{"event":"paid","amount":1}`))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+	assert.Equal(t, 1, len(emitC))
+	<-emitC
+
+	req, err = http.NewRequest("", "", bytes.NewBufferString(`{"other":"paid","amount":1}`))
+	assert.Nil(t, err)
+	err = tw.webhookHandler(req)
+	se, ok := err.(*webman.StatusError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, se.Code)
+	assert.Contains(t, se.Error(), "event is required")
+	assert.Equal(t, 0, len(emitC))
+
+	req, err = http.NewRequest("", "", bytes.NewBufferString(`{"event":1}`))
+	assert.Nil(t, err)
+	ve, ok := tw.webhookHandler(req).(*webman.StatusError).Err.(*webman.ValidationError)
+	assert.True(t, ok)
+	assert.Len(t, ve.Messages, 2)
+
+	_, err = New(
+		LogOutputOption(ioutil.Discard),
+		WebhookOption("test", "test"),
+		WebhookSchemaOption([]byte(`{"type":1}`)),
+	)
+	assert.NotNil(t, err)
+}
+
+func TestOnRequestEventTransform(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookTransformOption(func(req *http.Request, event *Event) error {
+		tenant := req.Header.Get("X-Tenant")
+		if tenant == "" {
+			return errors.New("tenant is missing")
+		}
+		event.Body.(map[string]interface{})["tenant"] = tenant
+		return nil
+	}))
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("", "", bytes.NewBufferString(`{"event":"paid"}`))
+	assert.Nil(t, err)
+	req.Header.Set("X-Tenant", "acme")
+	assert.Nil(t, tw.webhookHandler(req))
+	var out Event
+	assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+	assert.Equal(t, map[string]interface{}{"event": "paid", "tenant": "acme"}, out.Body)
+
+	req, err = http.NewRequest("", "", bytes.NewBufferString(`{"event":"paid"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, &webman.StatusError{
+		Code: http.StatusBadRequest,
+		Err:  errors.New("tenant is missing"),
+	}, tw.webhookHandler(req))
+	assert.Equal(t, 0, len(emitC))
+}
+
+func TestOnRequestEventTimestamp(t *testing.T) {
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	emitC := make(chan *service.EmitEventRequest, 10)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw,
+		WebhookTimestampOption("X-Timestamp", time.Minute*5),
+		ClockOption(func() time.Time { return now }),
+	)
+
+	go s.Start()
+	<-tw.startC
+
+	tests := []struct {
+		timestamp string
+		accepted  bool
+	}{
+		{strconv.FormatInt(now.Unix(), 10), true},
+		{strconv.FormatInt(now.Add(-time.Minute).Unix(), 10), true},
+		{now.Add(time.Minute).Format(time.RFC3339), true},
+		{strconv.FormatInt(now.Add(-time.Minute*10).Unix(), 10), false},
+		{now.Add(time.Hour).Format(time.RFC3339), false},
+		{"yesterday", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("", "", bytes.NewBufferString(`{"body":"test"}`))
+		assert.Nil(t, err)
+		req.Header.Set("X-Timestamp", test.timestamp)
+		err = tw.webhookHandler(req)
+		if test.accepted {
+			assert.Nil(t, err, test.timestamp)
+			<-emitC
+			continue
+		}
+		se, ok := err.(*webman.StatusError)
+		assert.True(t, ok, test.timestamp)
+		assert.Equal(t, http.StatusBadRequest, se.Code, test.timestamp)
+		assert.Equal(t, 0, len(emitC), test.timestamp)
+	}
+}
+
+func TestOnRequestEventTenantKey(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 3)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookTenantHeaderOption("X-Tenant", "onRequest."))
+
+	go s.Start()
+	<-tw.startC
+
+	for _, tenant := range []string{"acme", "globex", ""} {
+		req, err := http.NewRequest("", "", bytes.NewBufferString(`{"body":"test"}`))
+		assert.Nil(t, err)
+		req.Header.Set("X-Tenant", tenant)
+		assert.Nil(t, tw.webhookHandler(req))
+	}
+	assert.Equal(t, "onRequest.acme", (<-emitC).EventKey)
+	assert.Equal(t, "onRequest.globex", (<-emitC).EventKey)
+	assert.Equal(t, "onRequest", (<-emitC).EventKey)
+}
+
+func TestOnRequestEventRedact(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookRedactOption([]string{"email", "card.number", "items.secret", "missing.field"}))
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("", "", bytes.NewBufferString(`{
+		"email": "user@mesg.com",
+		"name": "user",
+		"card": {"number": "4242", "brand": "visa"},
+		"items": [{"id": 1, "secret": "a"}, {"id": 2}]
+	}`))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+
+	var out Event
+	assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+	assert.Equal(t, map[string]interface{}{
+		"name": "user",
+		"card": map[string]interface{}{"brand": "visa"},
+		"items": []interface{}{
+			map[string]interface{}{"id": float64(1)},
+			map[string]interface{}{"id": float64(2)},
+		},
+	}, out.Body)
+}
+
+func TestOnRequestEventFieldKeys(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw,
+		WebhookBodyKeyOption("payload"),
+		WebhookDateKeyOption("receivedAt"),
+		WebhookIDKeyOption("eventId"),
+		IDGeneratorOption(func() string { return "1" }),
+	)
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("", "", bytes.NewBufferString(`{"name":"test"}`))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+
+	var out map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+	assert.Equal(t, map[string]interface{}{"name": "test"}, out["payload"])
+	assert.Equal(t, "1", out["eventId"])
+	assert.NotNil(t, out["receivedAt"])
+	assert.NotNil(t, out["timestamp"])
+	for _, key := range []string{"body", "date", "id"} {
+		_, ok := out[key]
+		assert.False(t, ok, key)
+	}
+}
+
+func TestOnRequestEventRouteKeys(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 5)
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, nil,
+		WebhookOption("/webhook", "127.0.0.1:0"),
+		WebhookRouteKeyOption(map[string]string{
+			"/stripe":         "onStripe",
+			"/github":         "onGithub",
+			"/github/release": "onGithubRelease",
+		}),
+	)
+	wm := s.webman.(*webman.Webman)
+	go s.Start()
+	defer s.Close()
+	<-wm.Ready()
+
+	_, port, err := net.SplitHostPort(wm.WebhookAddr())
+	assert.Nil(t, err)
+	for _, path := range []string{"/stripe/payment", "/github/push", "/github/release", "/webhook"} {
+		resp, err := http.Post("http://127.0.0.1:"+port+path, "application/json",
+			bytes.NewBufferString(`{"body":"test"}`))
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode, path)
+	}
+	assert.Equal(t, "onStripe", (<-emitC).EventKey)
+	assert.Equal(t, "onGithub", (<-emitC).EventKey)
+	assert.Equal(t, "onGithubRelease", (<-emitC).EventKey)
+	assert.Equal(t, "onRequest", (<-emitC).EventKey)
+}
+
+func TestOnRequestEventHostKeys(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 3)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw,
+		WebhookHostKeyOption(map[string]string{"stripe.mesg.com": "onStripe"}),
+		WebhookRouteKeyOption(map[string]string{"/github": "onGithub"}),
+	)
+
+	go s.Start()
+	<-tw.startC
+
+	for _, target := range []string{
+		"http://Stripe.mesg.com:4000/webhook",
+		"http://stripe.mesg.com/github",
+		"http://other.mesg.com/webhook",
+	} {
+		req, err := http.NewRequest("POST", target, bytes.NewBufferString(`{"body":"test"}`))
+		assert.Nil(t, err)
+		assert.Nil(t, tw.webhookHandler(req))
+	}
+	assert.Equal(t, "onStripe", (<-emitC).EventKey)
+	assert.Equal(t, "onGithub", (<-emitC).EventKey)
+	assert.Equal(t, "onRequest", (<-emitC).EventKey)
+}
+
+func TestOnRequestEventContentTypes(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookContentTypesOption("application/x-www-form-urlencoded", "text/plain"))
+
+	go s.Start()
+	<-tw.startC
+
+	tests := []struct {
+		contentType string
+		body        string
+		expected    interface{}
+	}{
+		{"application/x-www-form-urlencoded", "a=1&b=2&b=3",
+			map[string]interface{}{"a": "1", "b": []interface{}{"2", "3"}}},
+		{"text/plain; charset=utf-8", "hello", "hello"},
+		{"application/json", `{"a":"1"}`, map[string]interface{}{"a": "1"}},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", "", bytes.NewBufferString(test.body))
+		assert.Nil(t, err)
+		req.Header.Set("Content-Type", test.contentType)
+		assert.Nil(t, tw.webhookHandler(req))
+		ed := <-emitC
+
+		var out Event
+		assert.Nil(t, json.Unmarshal([]byte(ed.EventData), &out))
+		assert.Equal(t, test.expected, out.Body)
+	}
+}
+
+func TestUnsupportedContentType(t *testing.T) {
+	_, err := New(
+		LogOutputOption(ioutil.Discard),
+		WebhookOption("test", "test"),
+		WebhookContentTypesOption("application/xml"),
+	)
+	assert.NotNil(t, err)
+}
+
+func TestOnRequestEventRequestID(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw)
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("POST", "", bytes.NewBufferString(`{}`))
+	assert.Nil(t, err)
+	req = req.WithContext(webman.WithRequestID(req.Context(), "id"))
+	assert.Nil(t, tw.webhookHandler(req))
+	ed := <-emitC
+
+	var out Event
+	assert.Nil(t, json.Unmarshal([]byte(ed.EventData), &out))
+	assert.Equal(t, "id", out.ID)
+}
+
+func TestWebhookConcurrency(t *testing.T) {
+	limit := 2
+	emitC := make(chan *service.EmitEventRequest, 0)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookConcurrencyOption(limit, 0))
+
+	go s.Start()
+	<-tw.startC
+
+	total := 5
+	errC := make(chan error, total)
+	for i := 0; i < total; i++ {
+		req, err := http.NewRequest("POST", "", bytes.NewBufferString(`{}`))
+		assert.Nil(t, err)
+		go func() { errC <- tw.webhookHandler(req) }()
+	}
+
+	// blocked emits hold their slots so the rest must be rejected.
+	for i := 0; i < total-limit; i++ {
+		err := <-errC
+		se, ok := err.(*webman.StatusError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusTooManyRequests, se.Code)
+	}
+	for i := 0; i < limit; i++ {
+		<-emitC
+		assert.Nil(t, <-errC)
+	}
+}
+
+func TestWebhookConcurrencyNoLimit(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		s := newTestService(t, &testClient{
+			stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+		}, &testWebman{}, WebhookConcurrencyOption(n, 0))
+		assert.Nil(t, s.webhookSem)
+	}
+}
+
+func TestInjectWebhook(t *testing.T) {
+	body := map[string]interface{}{"body": "test"}
+	emitC := make(chan *service.EmitEventRequest, 2)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw)
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("POST", "", bytes.NewBufferString(`{"body":"test"}`))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+	assert.Nil(t, s.InjectWebhook(body))
+
+	var posted, injected Event
+	ed := <-emitC
+	assert.Nil(t, json.Unmarshal([]byte(ed.EventData), &posted))
+	ed1 := <-emitC
+	assert.Equal(t, ed.EventKey, ed1.EventKey)
+	assert.Nil(t, json.Unmarshal([]byte(ed1.EventData), &injected))
+
+	assert.Equal(t, posted.Body, injected.Body)
+	assert.NotEmpty(t, injected.Date)
+	_, err = uuid.FromString(injected.ID)
+	assert.Nil(t, err)
+}
+
+func TestInjectWebhookPipeline(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookSchemaOption([]byte(`{"type":"object","required":["user"]}`)))
+
+	go s.Start()
+	<-tw.startC
+
+	err := s.InjectWebhook(map[string]interface{}{"name": "a"})
+	assert.Equal(t, http.StatusBadRequest, err.(*webman.StatusError).Code)
+
+	assert.Nil(t, s.InjectWebhook(map[string]interface{}{"user": "a"}))
+	var out Event
+	assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+	assert.Equal(t, map[string]interface{}{"user": "a"}, out.Body)
+	assert.Equal(t, int64(2), s.Stats().WebhookRequests)
+}
+
+func TestInjectWebhookRedact(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookRedactOption([]string{"card.number"}))
+
+	go s.Start()
+	<-tw.startC
+
+	assert.Nil(t, s.InjectWebhook(map[string]interface{}{
+		"card": map[string]interface{}{"number": "4242", "brand": "visa"},
+	}))
+	var out Event
+	assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+	assert.Equal(t, map[string]interface{}{
+		"card": map[string]interface{}{"brand": "visa"},
+	}, out.Body)
+}
+
+func TestOnRequestEventCustomDecoder(t *testing.T) {
+	csvDecoder := func(r io.Reader) (interface{}, error) {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Split(strings.TrimSpace(string(data)), ","), nil
+	}
+
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookDecoderOption(csvDecoder))
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("POST", "", bytes.NewBufferString("a,b,c\n"))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "text/csv")
+	assert.Nil(t, tw.webhookHandler(req))
+	ed := <-emitC
+
+	var out Event
+	assert.Nil(t, json.Unmarshal([]byte(ed.EventData), &out))
+	assert.Equal(t, []interface{}{"a", "b", "c"}, out.Body)
+}
+
+func TestWebhookEmptyBody(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 2)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookEmptyBodyOption(map[string]interface{}{"ping": true}))
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("POST", "", bytes.NewBufferString(""))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+	var out Event
+	assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+	assert.Equal(t, map[string]interface{}{"ping": true}, out.Body)
+
+	// bodies that aren't empty are still decoded.
+	req, err = http.NewRequest("POST", "", bytes.NewBufferString(`{"ping":false}`))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+	out = Event{}
+	assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+	assert.Equal(t, map[string]interface{}{"ping": false}, out.Body)
+}
+
+func TestWebhookEmptyBodyNotAccepted(t *testing.T) {
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  make(chan *service.EmitEventRequest, 1),
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw)
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("POST", "", bytes.NewBufferString(""))
+	assert.Nil(t, err)
+	err = tw.webhookHandler(req)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "json data payload expected")
+}
+
+func TestWebhookUseNumber(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookUseNumberOption(true))
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("POST", "", bytes.NewBufferString(`{"id":12345678901234567890}`))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+
+	var out struct {
+		Body struct {
+			ID json.RawMessage `json:"id"`
+		} `json:"body"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+	assert.Equal(t, "12345678901234567890", string(out.Body.ID))
+}
+
+func TestWebhookDisallowUnknownFields(t *testing.T) {
+	type payment struct {
+		Amount int `json:"amount"`
+	}
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookBodyTypeOption(payment{}), WebhookDisallowUnknownFieldsOption(true))
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("POST", "", bytes.NewBufferString(`{"amount":10,"currency":"usd"}`))
+	assert.Nil(t, err)
+	assert.NotNil(t, tw.webhookHandler(req))
+
+	req, err = http.NewRequest("POST", "", bytes.NewBufferString(`{"amount":10}`))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+
+	var out Event
+	assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+	assert.Equal(t, map[string]interface{}{"amount": float64(10)}, out.Body)
+}
+
+func TestLocalEvents(t *testing.T) {
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  make(chan *service.EmitEventRequest, 3),
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, LocalEventsOption(2))
+
+	go s.Start()
+	<-tw.startC
+
+	for i := 1; i <= 3; i++ {
+		req, err := http.NewRequest("", "", bytes.NewBufferString(fmt.Sprintf(`{"n":%d}`, i)))
+		assert.Nil(t, err)
+		assert.Nil(t, tw.webhookHandler(req))
+	}
+
+	ids := map[string]bool{}
+	for i := 1; i <= 2; i++ {
+		event := <-s.Events()
+		assert.Equal(t, map[string]interface{}{"n": float64(i)}, event.Body)
+		assert.NotEmpty(t, event.ID)
+		ids[event.ID] = true
+	}
+	assert.Len(t, ids, 2)
+	assert.Equal(t, int64(1), s.DroppedEvents())
+}
+
+func TestEmitBatch(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 5)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookFanOutOption(true), EmitBatchOption(3, 50*time.Millisecond))
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("POST", "", bytes.NewBufferString(`[{"n":1},{"n":2},{"n":3},{"n":4},{"n":5}]`))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+
+	var ns []float64
+	for _, size := range []int{3, 2} {
+		ed := <-emitC
+		assert.Equal(t, "onRequestBatch", ed.EventKey)
+		var batch struct {
+			Events []Event `json:"events"`
+		}
+		assert.Nil(t, json.Unmarshal([]byte(ed.EventData), &batch))
+		assert.Len(t, batch.Events, size)
+		for _, event := range batch.Events {
+			ns = append(ns, event.Body.(map[string]interface{})["n"].(float64))
+		}
+	}
+	assert.Equal(t, []float64{1, 2, 3, 4, 5}, ns)
+
+	select {
+	case ed := <-emitC:
+		t.Fatalf("unexpected emit: %s", ed.EventData)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookSequence(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 3)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, WebhookSequenceOption(true))
+
+	go s.Start()
+	<-tw.startC
+
+	for i := int64(1); i <= 3; i++ {
+		req, err := http.NewRequest("POST", "", bytes.NewBufferString(`{}`))
+		assert.Nil(t, err)
+		assert.Nil(t, tw.webhookHandler(req))
+
+		var out Event
+		assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+		assert.Equal(t, i, out.Sequence)
+	}
+}
+
+func TestWebhookDebugBuffer(t *testing.T) {
+	s := newTestService(t, &testClient{
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+		emitC:  make(chan *service.EmitEventRequest, 3),
+	}, nil, WebhookOption("/webhook", "127.0.0.1:0"), WebhookDebugBufferOption("/debug/events", 2))
+	wm := s.webman.(*webman.Webman)
+	go s.Start()
+	defer s.Close()
+	<-wm.Ready()
+
+	_, port, err := net.SplitHostPort(wm.WebhookAddr())
+	assert.Nil(t, err)
+	addr := "http://127.0.0.1:" + port
+	for i := 1; i <= 3; i++ {
+		resp, err := http.Post(addr+"/webhook", "application/json",
+			bytes.NewBufferString(fmt.Sprintf(`{"n":%d}`, i)))
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+
+	resp, err := http.Get(addr + "/debug/events")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var events []Event
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&events))
+	assert.Len(t, events, 2)
+	assert.Equal(t, map[string]interface{}{"n": float64(2)}, events[0].Body)
+	assert.Equal(t, map[string]interface{}{"n": float64(3)}, events[1].Body)
+}
+
+func TestOnRequestEventIDGenerator(t *testing.T) {
+	var seq int
+	idGenerator := func() string {
+		seq++
+		return fmt.Sprintf("event-%d", seq)
+	}
+
+	emitC := make(chan *service.EmitEventRequest, 3)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, IDGeneratorOption(idGenerator))
+
+	go s.Start()
+	<-tw.startC
+
+	for i := 1; i <= 3; i++ {
+		req, err := http.NewRequest("POST", "", bytes.NewBufferString(`{}`))
+		assert.Nil(t, err)
+		assert.Nil(t, tw.webhookHandler(req))
+
+		var out Event
+		assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+		assert.Equal(t, fmt.Sprintf("event-%d", i), out.ID)
+	}
+}
+
+func TestOnRequestEventClock(t *testing.T) {
+	now := time.Date(2018, 7, 1, 12, 30, 15, 123456789, time.UTC)
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, ClockOption(func() time.Time { return now }))
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("POST", "", bytes.NewBufferString(`{}`))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+
+	var out Event
+	assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+	assert.Equal(t, now.Unix(), out.Date)
+	assert.Equal(t, int64(1530448215123), out.Timestamp)
+}
+
+func TestWebhookMethodEventKeys(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 2)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw,
+		WebhookMethodsOption("GET", "POST"),
+		WebhookMethodEventKeysOption(true),
+		WebhookRouteKeyOption(map[string]string{"/github": "onGithub"}),
+	)
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("POST", "/webhook", bytes.NewBufferString(`{"a":"b"}`))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+	event := <-emitC
+	assert.Equal(t, "onRequest.POST", event.EventKey)
+
+	req, err = http.NewRequest("GET", "/webhook", http.NoBody)
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+	event = <-emitC
+	assert.Equal(t, "onRequest.GET", event.EventKey)
+	var out Event
+	assert.Nil(t, json.Unmarshal([]byte(event.EventData), &out))
+	assert.Nil(t, out.Body)
+
+	req, err = http.NewRequest("GET", "/github/push", http.NoBody)
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+	assert.Equal(t, "onGithub.GET", (<-emitC).EventKey)
+}
+
+func TestEmitRetry(t *testing.T) {
+	var calls int32
+	failures := int32(2)
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+		emitErr: func() error {
+			if atomic.AddInt32(&calls, 1) <= atomic.LoadInt32(&failures) {
+				return errors.New("unavailable")
+			}
+			return nil
+		},
+	}, tw, EmitRetryOption(3, time.Millisecond))
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("POST", "", bytes.NewBufferString(`{}`))
+	assert.Nil(t, err)
+	assert.Nil(t, tw.webhookHandler(req))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	<-emitC
+
+	atomic.StoreInt32(&calls, 0)
+	atomic.StoreInt32(&failures, 3)
+	req, err = http.NewRequest("POST", "", bytes.NewBufferString(`{}`))
+	assert.Nil(t, err)
+	err = tw.webhookHandler(req)
+	se, ok := err.(*webman.StatusError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, se.Code)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestWebhookSyncEmit(t *testing.T) {
+	emitErr := errors.New("unavailable")
+	emitC := make(chan *service.EmitEventRequest, 1)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+		emitErr: func() error {
+			return emitErr
+		},
+	}, tw, WebhookSyncEmitOption(true))
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("POST", "", bytes.NewBufferString(`{}`))
+	assert.Nil(t, err)
+	se, ok := tw.webhookHandler(req).(*webman.StatusError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, se.Code)
+
+	emitErr = nil
+	req, err = http.NewRequest("POST", "", bytes.NewBufferString(`{}`))
+	assert.Nil(t, err)
+	se, ok = tw.webhookHandler(req).(*webman.StatusError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusOK, se.Code)
+	assert.Nil(t, se.Err)
+	<-emitC
+}
+
+func TestEventBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webman-buffer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	down := int32(1)
+	emitC := make(chan *service.EmitEventRequest, 3)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+		emitErr: func() error {
+			if atomic.LoadInt32(&down) == 1 {
+				return errors.New("unavailable")
+			}
+			return nil
+		},
+	}, tw, EventBufferOption(dir, 10), eventBufferFlushIntervalOption(time.Millisecond*10))
+
+	go s.Start()
+	<-tw.startC
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("POST", "", bytes.NewBufferString(fmt.Sprintf(`{"i":%d}`, i)))
+		assert.Nil(t, err)
+		assert.Nil(t, tw.webhookHandler(req))
+	}
+	assert.Equal(t, 0, len(emitC))
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(files))
+
+	atomic.StoreInt32(&down, 0)
+	for i := 0; i < 3; i++ {
+		ed := <-emitC
+		assert.Equal(t, "onRequest", ed.EventKey)
+		var out Event
+		assert.Nil(t, json.Unmarshal([]byte(ed.EventData), &out))
+		assert.Equal(t, map[string]interface{}{"i": float64(i)}, out.Body)
+	}
+	s.Close()
+}
+
+func TestEventBufferPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webman-buffer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	b, err := newEventBuffer(dir, 2)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, b.push("key", i))
+	}
+	assert.Equal(t, 2, b.len())
+
+	b, err = newEventBuffer(dir, 2)
+	assert.Nil(t, err)
+	var emitted []string
+	assert.Nil(t, b.flush(func(key string, data interface{}) error {
+		emitted = append(emitted, string(data.(json.RawMessage)))
+		return nil
+	}))
+	assert.Equal(t, []string{"1", "2"}, emitted)
+	assert.Equal(t, 0, b.len())
+}
+
+func TestPrioritySemCancel(t *testing.T) {
+	sem := newPrioritySem(1)
+	assert.Nil(t, sem.acquire(context.Background(), 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error, 1)
+	go func() { errC <- sem.acquire(ctx, 10) }()
+	for sem.waiting() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-errC)
+	assert.Equal(t, 0, sem.waiting())
+
+	// the slot isn't lost by the canceled waiter.
+	sem.release()
+	assert.Nil(t, sem.acquire(context.Background(), 0))
+}
+
+func TestDedupCache(t *testing.T) {
+	c := newDedupCache(time.Millisecond*50, 2)
+	assert.False(t, c.seen("1"))
+	assert.True(t, c.seen("1"))
+	assert.False(t, c.seen("2"))
+	assert.False(t, c.seen("3"))
+	assert.False(t, c.seen("1"))
+
+	time.Sleep(time.Millisecond * 60)
+	assert.False(t, c.seen("3"))
+
+	c.forget("3")
+	assert.False(t, c.seen("3"))
+}
+
 func TestTasks(t *testing.T) {
 	taskKey := "execute"
 	taskBatchKey := "batchExecute"
@@ -95,79 +1259,2019 @@ func TestTasks(t *testing.T) {
 		URL:  "http://mesg.com",
 		Body: postPayload,
 	}
-	inputDataBatch := httpBatchRequest{
+	inputDataBatch := httpBatchRequest{
+		Batch: []httpRequest{
+			httpRequest{
+				URL:  "http://mesg.com",
+				Body: postPayload,
+			}, httpRequest{
+				URL:  "http://mesg.tech",
+				Body: postPayload,
+			}},
+	}
+	inputDataBytes, err := json.Marshal(inputData)
+	assert.Nil(t, err)
+	inputDataBatchBytes, err := json.Marshal(inputDataBatch)
+	assert.Nil(t, err)
+
+	srv, err := mesg.NewService(
+		mesg.ServiceTokenOption(token),
+		mesg.ServiceEndpointOption(endpoint),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, srv)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	srv.Client = &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		submitC: submitC,
+	}
+	tw := &testWebman{
+		payload:    postPayload,
+		statusCode: statusCode,
+		startC:     make(chan struct{}, 0),
+	}
+
+	s, err := New(
+		LogOutputOption(ioutil.Discard),
+		WebhookOption("test", "test"),
+		mesgServiceOption(srv),
+		applicationServiceOption(tw),
+	)
+	assert.Nil(t, err)
+	assert.NotNil(t, s)
+
+	go s.Start()
+
+	taskC <- &service.TaskData{
+		ExecutionID: executionID,
+		TaskKey:     taskKey,
+		InputData:   string(inputDataBytes),
+	}
+
+	reply := <-submitC
+	assert.Equal(t, "success", reply.OutputKey)
+	var out httpSuccessResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, statusCode, out.StatusCode)
+	assert.Equal(t, postPayload, out.Body)
+
+	taskC <- &service.TaskData{
+		ExecutionID: executionID,
+		TaskKey:     taskBatchKey,
+		InputData:   string(inputDataBatchBytes),
+	}
+
+	reply = <-submitC
+	assert.Equal(t, "batch", reply.OutputKey)
+	var outBatch httpBatchResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &outBatch))
+	assert.Equal(t, len(inputDataBatch.Batch), len(outBatch.Batch.Successes))
+	for _, data := range inputDataBatch.Batch {
+		assert.Equal(t, statusCode, outBatch.Batch.Successes[data.URL].StatusCode)
+		assert.Equal(t, postPayload, outBatch.Batch.Successes[data.URL].Body)
+	}
+}
+
+func TestOnErrorEvent(t *testing.T) {
+	url := "http://mesg.com"
+	postErr := errors.New("connection refused")
+	inputDataBytes, err := json.Marshal(httpRequest{URL: url})
+	assert.Nil(t, err)
+
+	srv, err := mesg.NewService(
+		mesg.ServiceTokenOption(token),
+		mesg.ServiceEndpointOption(endpoint),
+	)
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	emitC := make(chan *service.EmitEventRequest, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	srv.Client = &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   emitC,
+		submitC: submitC,
+	}
+	tw := &testWebman{
+		err:    postErr,
+		startC: make(chan struct{}, 0),
+	}
+
+	s, err := New(
+		LogOutputOption(ioutil.Discard),
+		WebhookOption("test", "test"),
+		ErrorEventKeyOption("onFailure"),
+		mesgServiceOption(srv),
+		applicationServiceOption(tw),
+	)
+	assert.Nil(t, err)
+
+	go s.Start()
+
+	taskC <- &service.TaskData{
+		ExecutionID: "executionID",
+		TaskKey:     "execute",
+		InputData:   string(inputDataBytes),
+	}
+
+	ed := <-emitC
+	assert.Equal(t, "onFailure", ed.EventKey)
+	var out errorEvent
+	assert.Nil(t, json.Unmarshal([]byte(ed.EventData), &out))
+	assert.Equal(t, url, out.URL)
+	assert.Equal(t, postErr.Error(), out.Message)
+
+	reply := <-submitC
+	assert.Equal(t, "error", reply.OutputKey)
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	inputDataBytes, err := json.Marshal(httpRequest{URL: ts.URL, Timeout: 50})
+	assert.Nil(t, err)
+
+	srv, err := mesg.NewService(
+		mesg.ServiceTokenOption(token),
+		mesg.ServiceEndpointOption(endpoint),
+	)
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	emitC := make(chan *service.EmitEventRequest, 1)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	srv.Client = &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   emitC,
+		submitC: submitC,
+	}
+
+	wm, err := webman.New(
+		webman.LoggerOption(log.New(ioutil.Discard, "", 0)),
+		webman.TimeoutOption(time.Second*10),
+	)
+	assert.Nil(t, err)
+
+	s, err := New(
+		LogOutputOption(ioutil.Discard),
+		WebhookOption("test", "test"),
+		mesgServiceOption(srv),
+		applicationServiceOption(&testWebhooklessApp{wm}),
+	)
+	assert.Nil(t, err)
+
+	go s.listenTasks()
+
+	start := time.Now()
+	taskC <- &service.TaskData{
+		ExecutionID: "executionID",
+		TaskKey:     "execute",
+		InputData:   string(inputDataBytes),
+	}
+
+	reply := <-submitC
+	assert.Equal(t, "error", reply.OutputKey)
+	assert.True(t, time.Since(start) < time.Second)
+
+	var out httpErrorResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, "upstream request timed out after 50ms", out.Message)
+}
+
+func TestExecuteTimeoutLongerThanDefault(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 300)
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	wm, err := webman.New(
+		webman.LoggerOption(log.New(ioutil.Discard, "", 0)),
+		webman.TimeoutOption(time.Millisecond*100),
+	)
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: ts.URL, Timeout: 5000})
+	assert.Equal(t, "success", reply.OutputKey)
+
+	reply = execTestTask(t, taskC, submitC, "execute", httpRequest{URL: ts.URL})
+	assert.Equal(t, "error", reply.OutputKey)
+}
+
+func TestCloseWaitsInflightTasks(t *testing.T) {
+	hitC := make(chan struct{}, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hitC <- struct{}{}
+		time.Sleep(time.Millisecond * 100)
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+
+	inputDataBytes, err := json.Marshal(httpBatchRequest{
+		Batch: []httpRequest{{URL: ts.URL + "/1"}, {URL: ts.URL + "/2"}},
+	})
+	assert.Nil(t, err)
+
+	srv, err := mesg.NewService(
+		mesg.ServiceTokenOption(token),
+		mesg.ServiceEndpointOption(endpoint),
+	)
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	srv.Client = &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		submitC: submitC,
+	}
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	s, err := New(
+		LogOutputOption(ioutil.Discard),
+		WebhookOption("test", "test"),
+		mesgServiceOption(srv),
+		applicationServiceOption(&testWebhooklessApp{wm}),
+	)
+	assert.Nil(t, err)
+
+	go s.listenTasks()
+
+	taskC <- &service.TaskData{
+		ExecutionID: "executionID",
+		TaskKey:     "batchExecute",
+		InputData:   string(inputDataBytes),
+	}
+	<-hitC
+
+	closedC := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closedC)
+	}()
+
+	reply := <-submitC
+	assert.Equal(t, "batch", reply.OutputKey)
+	var out httpBatchResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, 2, len(out.Batch.Successes))
+	<-closedC
+}
+
+func TestCloseShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hitC := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hitC <- struct{}{}
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	inputDataBytes, err := json.Marshal(httpRequest{URL: ts.URL})
+	assert.Nil(t, err)
+
+	srv, err := mesg.NewService(
+		mesg.ServiceTokenOption(token),
+		mesg.ServiceEndpointOption(endpoint),
+	)
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	srv.Client = &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: make(chan *service.SubmitResultRequest, 1),
+	}
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	s, err := New(
+		LogOutputOption(ioutil.Discard),
+		WebhookOption("test", "test"),
+		ShutdownTimeoutOption(time.Millisecond*50),
+		mesgServiceOption(srv),
+		applicationServiceOption(&testWebhooklessApp{wm}),
+	)
+	assert.Nil(t, err)
+
+	go s.listenTasks()
+
+	taskC <- &service.TaskData{
+		ExecutionID: "executionID",
+		TaskKey:     "execute",
+		InputData:   string(inputDataBytes),
+	}
+	<-hitC
+
+	start := time.Now()
+	assert.Nil(t, s.Close())
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestBatchSizeValidation(t *testing.T) {
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	tw := &testWebman{
+		payload:    map[string]interface{}{},
+		statusCode: http.StatusOK,
+	}
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		submitC: submitC,
+	}, tw, MaxBatchSizeOption(2))
+	go s.listenTasks()
+
+	tests := []struct {
+		batch     []httpRequest
+		outputKey string
+		message   string
+	}{
+		{[]httpRequest{}, "error", "batch is empty"},
+		{[]httpRequest{{URL: "1"}, {URL: "2"}, {URL: "3"}}, "error", "batch size 3 exceeds the limit of 2"},
+		{[]httpRequest{{URL: "1"}, {URL: "2"}}, "batch", ""},
+	}
+	for _, test := range tests {
+		reply := execTestTask(t, taskC, submitC, "batchExecute", httpBatchRequest{Batch: test.batch})
+		assert.Equal(t, test.outputKey, reply.OutputKey)
+		if test.message != "" {
+			var out httpErrorResponse
+			assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+			assert.Equal(t, test.message, out.Message)
+		}
+	}
+}
+
+func TestExecuteExpectStatus(t *testing.T) {
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	tw := &testWebman{payload: map[string]interface{}{"error": "not found"}}
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 10),
+		submitC: submitC,
+	}, tw)
+	go s.listenTasks()
+
+	tests := []struct {
+		statusCode   int
+		expectStatus string
+		outputKey    string
+	}{
+		{http.StatusNotFound, `200`, "error"},
+		{http.StatusNotFound, `"2xx"`, "error"},
+		{http.StatusOK, `200`, "success"},
+		{http.StatusCreated, `"200-299"`, "success"},
+		{http.StatusNotFound, `null`, "success"},
+	}
+	for _, test := range tests {
+		tw.statusCode = test.statusCode
+		input := json.RawMessage(`{"url":"http://mesg.com","expectStatus":` + test.expectStatus + `}`)
+		reply := execTestTask(t, taskC, submitC, "execute", input)
+		assert.Equal(t, test.outputKey, reply.OutputKey, test.expectStatus)
+		if test.outputKey == "error" {
+			var out httpErrorResponse
+			assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+			assert.Equal(t, test.statusCode, out.StatusCode)
+			assert.Contains(t, out.Message, "not found")
+		}
+	}
+}
+
+func TestHTTPDoer(t *testing.T) {
+	doer := &testDoer{
+		responses: []*webman.Response{
+			{StatusCode: http.StatusTooManyRequests, Body: []byte("slow down")},
+			{StatusCode: http.StatusOK, Body: []byte(`{"ok":true}`)},
+		},
+	}
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, tw, HTTPDoerOption(doer))
+	go s.listenTasks()
+
+	input := httpRequest{
+		Method:      "put",
+		URL:         "http://mesg.com",
+		Body:        map[string]interface{}{"a": "b"},
+		ContentType: "application/vnd.api+json",
+		Username:    "user",
+		Password:    "pass",
+		Timeout:     1000,
+	}
+	reply := execTestTask(t, taskC, submitC, "execute", input)
+	assert.Equal(t, "error", reply.OutputKey)
+	assert.Contains(t, reply.OutputData, "slow down")
+
+	reply = execTestTask(t, taskC, submitC, "execute", input)
+	assert.Equal(t, "success", reply.OutputKey)
+	var out httpSuccessResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, map[string]interface{}{"ok": true}, out.Body)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&tw.calls))
+	assert.Len(t, doer.requests, 2)
+	req := doer.requests[0]
+	assert.Equal(t, http.MethodPut, req.Method)
+	assert.Equal(t, "http://mesg.com", req.URL)
+	assert.Equal(t, input.Body, req.Body)
+	assert.Equal(t, "application/vnd.api+json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "Basic "+basicAuth("user", "pass"), req.Header.Get("Authorization"))
+	assert.True(t, doer.deadlines[0].After(time.Now()))
+	assert.True(t, doer.deadlines[0].Before(time.Now().Add(time.Second)))
+}
+
+func TestStatusLine(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	for _, enabled := range []bool{true, false} {
+		wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+		assert.Nil(t, err)
+
+		taskC := make(chan *service.TaskData, 0)
+		submitC := make(chan *service.SubmitResultRequest, 0)
+		s := newTestService(t, &testClient{
+			stream:  &taskDataStream{taskC: taskC},
+			emitC:   make(chan *service.EmitEventRequest, 1),
+			submitC: submitC,
+		}, &testWebhooklessApp{wm}, StatusLineOption(enabled))
+		go s.listenTasks()
+
+		reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: ts.URL})
+		assert.Equal(t, "success", reply.OutputKey)
+		var out httpSuccessResponse
+		assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+		assert.Equal(t, http.StatusCreated, out.StatusCode)
+		if enabled {
+			assert.Equal(t, "201 Created", out.Status)
+			assert.Equal(t, "HTTP/1.1", out.Proto)
+		} else {
+			assert.NotContains(t, reply.OutputData, "status\"")
+			assert.NotContains(t, reply.OutputData, "proto")
+		}
+
+		reply = execTestTask(t, taskC, submitC, "batchExecute", httpBatchRequest{
+			Batch: []httpRequest{{URL: ts.URL}},
+		})
+		var batch httpBatchResponse
+		assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &batch))
+		if enabled {
+			assert.Equal(t, "201 Created", batch.Batch.Successes[ts.URL].Status)
+		} else {
+			assert.Equal(t, "", batch.Batch.Successes[ts.URL].Status)
+		}
+	}
+}
+
+func TestExecuteErrorMessages(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	}))
+	defer ts.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 2),
+		submitC: submitC,
+	}, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: ts.URL})
+	assert.Equal(t, "error", reply.OutputKey)
+	var out httpErrorResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Contains(t, out.Message, "err while decoding the response: invalid character")
+	assert.Equal(t, "not json", out.Body)
+
+	reply = execTestTask(t, taskC, submitC, "execute", httpRequest{URL: "http://" + addr})
+	assert.Equal(t, "error", reply.OutputKey)
+	out = httpErrorResponse{}
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Contains(t, out.Message, "err while sending the request:")
+	assert.Contains(t, out.Message, "connection refused")
+}
+
+func TestExecuteErrorBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		if r.URL.Path == "/text" {
+			w.Write([]byte("invalid email"))
+			return
+		}
+		w.Write([]byte(`{"errors":[{"field":"email","message":"invalid"}]}`))
+	}))
+	defer ts.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 2),
+		submitC: submitC,
+	}, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	tests := []struct {
+		path string
+		body interface{}
+	}{
+		{"/json", map[string]interface{}{
+			"errors": []interface{}{
+				map[string]interface{}{"field": "email", "message": "invalid"},
+			},
+		}},
+		{"/text", "invalid email"},
+	}
+	for _, test := range tests {
+		input := json.RawMessage(`{"url":"` + ts.URL + test.path + `","expectStatus":"2xx"}`)
+		reply := execTestTask(t, taskC, submitC, "execute", input)
+		assert.Equal(t, "error", reply.OutputKey, test.path)
+		var out httpErrorResponse
+		assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+		assert.Equal(t, http.StatusUnprocessableEntity, out.StatusCode)
+		assert.Equal(t, test.body, out.Body, test.path)
+		assert.Contains(t, out.Message, "unexpected status code 422, expected 200-299", test.path)
+	}
+}
+
+func TestExecuteMethod(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"method": r.Method})
+	}))
+	defer ts.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		submitC: submitC,
+	}, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	for _, method := range []string{"", "get", "PUT"} {
+		reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: ts.URL, Method: method})
+		var out httpSuccessResponse
+		assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+		expected := strings.ToUpper(method)
+		if expected == "" {
+			expected = "POST"
+		}
+		assert.Equal(t, map[string]interface{}{"method": expected}, out.Body)
+	}
+}
+
+func TestExecuteRaw(t *testing.T) {
+	xml := "<message>hello</message>"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(xml))
+	}))
+	defer ts.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		submitC: submitC,
+	}, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: ts.URL, Raw: true})
+	assert.Equal(t, "success", reply.OutputKey)
+	var out httpSuccessResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, http.StatusOK, out.StatusCode)
+	assert.Equal(t, xml, out.Body)
+}
+
+func TestBatchDefaultBody(t *testing.T) {
+	bodies := make(chan map[string]interface{}, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		body["path"] = r.URL.Path
+		bodies <- body
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		submitC: submitC,
+	}, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "batchExecute", httpBatchRequest{
+		Batch: []httpRequest{
+			{URL: ts.URL + "/default"},
+			{URL: ts.URL + "/own", Body: map[string]interface{}{"name": "own"}},
+		},
+		DefaultBody: map[string]interface{}{"name": "default"},
+	})
+	assert.Equal(t, "batch", reply.OutputKey)
+
+	received := map[string]interface{}{}
+	for i := 0; i < 2; i++ {
+		body := <-bodies
+		received[body["path"].(string)] = body["name"]
+	}
+	assert.Equal(t, map[string]interface{}{
+		"/default": "default",
+		"/own":     "own",
+	}, received)
+}
+
+func TestBatchBodyTemplate(t *testing.T) {
+	bodies := make(chan map[string]interface{}, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		body["path"] = r.URL.Path
+		bodies <- body
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		submitC: submitC,
+	}, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "batchExecute", httpBatchRequest{
+		Batch: []httpRequest{
+			{URL: ts.URL + "/alice", Vars: map[string]string{"name": "alice", "id": "1"}},
+			{URL: ts.URL + "/bob", Vars: map[string]string{"name": "bob", "id": "2"}},
+		},
+		BodyTemplate: map[string]interface{}{
+			"greeting": "hello ${name}",
+			"tags":     []interface{}{"user-${id}", "${unknown}"},
+		},
+	})
+	assert.Equal(t, "batch", reply.OutputKey)
+
+	received := map[string]interface{}{}
+	for i := 0; i < 2; i++ {
+		body := <-bodies
+		path := body["path"].(string)
+		delete(body, "path")
+		received[path] = body
+	}
+	assert.Equal(t, map[string]interface{}{
+		"/alice": map[string]interface{}{
+			"greeting": "hello alice",
+			"tags":     []interface{}{"user-1", "${unknown}"},
+		},
+		"/bob": map[string]interface{}{
+			"greeting": "hello bob",
+			"tags":     []interface{}{"user-2", "${unknown}"},
+		},
+	}, received)
+}
+
+func TestExecuteBasicAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("unauthorized"))
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	wm, err := webman.New(webman.LoggerOption(log.New(&logs, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		emitErr: func() error { return errors.New("emit failed") },
+		submitC: submitC,
+	}, &testWebhooklessApp{wm}, LogOutputOption(&logs))
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "execute", httpRequest{
+		URL:      ts.URL,
+		Username: "user",
+		Password: "secret",
+	})
+	assert.Equal(t, "success", reply.OutputKey)
+
+	reply = execTestTask(t, taskC, submitC, "execute", httpRequest{
+		URL:      ts.URL,
+		Username: "user",
+		Password: "wrong-secret",
+	})
+	assert.Equal(t, "error", reply.OutputKey)
+	assert.NotContains(t, reply.OutputData, "wrong-secret")
+	assert.NotEmpty(t, logs.String())
+	assert.NotContains(t, logs.String(), "secret")
+}
+
+func TestBatchContentType(t *testing.T) {
+	contentTypes := make(chan [2]string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentTypes <- [2]string{r.URL.Path, r.Header.Get("Content-Type")}
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		submitC: submitC,
+	}, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "batchExecute", httpBatchRequest{
+		Batch: []httpRequest{
+			{URL: ts.URL + "/default"},
+			{URL: ts.URL + "/own", ContentType: "application/merge-patch+json"},
+		},
+		ContentType: "application/vnd.api+json",
+	})
+	assert.Equal(t, "batch", reply.OutputKey)
+	var out httpBatchResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, 2, out.Summary.Successes)
+
+	received := map[string]string{}
+	for i := 0; i < 2; i++ {
+		ct := <-contentTypes
+		received[ct[0]] = ct[1]
+	}
+	assert.Equal(t, map[string]string{
+		"/default": "application/vnd.api+json",
+		"/own":     "application/merge-patch+json",
+	}, received)
+
+	reply = execTestTask(t, taskC, submitC, "execute", httpRequest{URL: ts.URL})
+	assert.Equal(t, "success", reply.OutputKey)
+	assert.Equal(t, "application/json", (<-contentTypes)[1])
+}
+
+func TestExecuteInsecureSkipVerify(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: ts.URL, InsecureSkipVerify: true})
+	assert.Equal(t, "success", reply.OutputKey)
+
+	reply = execTestTask(t, taskC, submitC, "execute", httpRequest{URL: ts.URL})
+	assert.Equal(t, "error", reply.OutputKey)
+	assert.Contains(t, reply.OutputData, "certificate")
+}
+
+func TestBatchSummary(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 10)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("internal error"))
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "batchExecute", httpBatchRequest{
 		Batch: []httpRequest{
-			httpRequest{
-				URL:  "http://mesg.com",
-				Body: postPayload,
-			}, httpRequest{
-				URL:  "http://mesg.tech",
-				Body: postPayload,
-			}},
+			{URL: ts.URL + "/1"},
+			{URL: ts.URL + "/2"},
+			{URL: ts.URL + "/fail"},
+		},
+	})
+	assert.Equal(t, "batch", reply.OutputKey)
+
+	var out httpBatchResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, 3, out.Summary.Total)
+	assert.Equal(t, 2, out.Summary.Successes)
+	assert.Equal(t, 1, out.Summary.Errors)
+	assert.True(t, out.Summary.TotalDuration >= 30)
+	assert.True(t, out.Summary.AvgDuration >= 10)
+	assert.InDelta(t, out.Summary.TotalDuration/3, out.Summary.AvgDuration, 0.001)
+}
+
+func TestBatchSummaryDuplicateURLs(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "batchExecute", httpBatchRequest{
+		Batch: []httpRequest{{URL: ts.URL}, {URL: ts.URL}, {URL: ts.URL}},
+	})
+
+	var out httpBatchResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, 3, out.Summary.Total)
+	assert.Equal(t, 3, out.Summary.Successes)
+	assert.Equal(t, 0, out.Summary.Errors)
+}
+
+func TestBatchSingleReply(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	client := &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		submitC: submitC,
 	}
-	inputDataBytes, err := json.Marshal(inputData)
+	s := newTestService(t, client, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	var batch []httpRequest
+	for i := 0; i < 50; i++ {
+		batch = append(batch, httpRequest{URL: fmt.Sprintf("%s/%d", ts.URL, i)})
+	}
+	reply := execTestTask(t, taskC, submitC, "batchExecute", httpBatchRequest{Batch: batch})
+	assert.Equal(t, "batch", reply.OutputKey)
+
+	// all the results are in the only reply that core accepts for the execution.
+	var out httpBatchResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Len(t, out.Batch.Successes, 50)
+	assert.Equal(t, 50, out.Summary.Successes)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&client.rejectedResults))
+}
+
+func TestBatchPriority(t *testing.T) {
+	blockC := make(chan struct{})
+	blockedC := make(chan struct{})
+	var (
+		m     sync.Mutex
+		times = map[string]time.Time{}
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			close(blockedC)
+			<-blockC
+		} else {
+			m.Lock()
+			times[r.URL.Path] = time.Now()
+			m.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
 	assert.Nil(t, err)
-	inputDataBatchBytes, err := json.Marshal(inputDataBatch)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, &testWebhooklessApp{wm}, GlobalConcurrencyOption(1))
+	go s.listenTasks()
+
+	// take the only slot so all batch requests wait for it.
+	inputBytes, err := json.Marshal(httpRequest{URL: ts.URL + "/block"})
+	assert.Nil(t, err)
+	taskC <- &service.TaskData{ExecutionID: "block", TaskKey: "execute", InputData: string(inputBytes)}
+	<-blockedC
+
+	inputBytes, err = json.Marshal(httpBatchRequest{
+		Batch: []httpRequest{
+			{URL: ts.URL + "/low", Priority: -1},
+			{URL: ts.URL + "/default"},
+			{URL: ts.URL + "/high", Priority: 10},
+			{URL: ts.URL + "/medium", Priority: 5},
+		},
+	})
+	assert.Nil(t, err)
+	taskC <- &service.TaskData{ExecutionID: "batch", TaskKey: "batchExecute", InputData: string(inputBytes)}
+	for s.upstreamSem.waiting() < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	close(blockC)
+
+	replies := map[string]*service.SubmitResultRequest{}
+	for i := 0; i < 2; i++ {
+		reply := <-submitC
+		replies[reply.ExecutionID] = reply
+	}
+	var out httpBatchResponse
+	assert.Nil(t, json.Unmarshal([]byte(replies["batch"].OutputData), &out))
+	assert.Equal(t, 4, out.Summary.Successes)
+	assert.Len(t, out.Batch.Successes, 4)
+
+	m.Lock()
+	defer m.Unlock()
+	order := []string{"/high", "/medium", "/default", "/low"}
+	for i := 1; i < len(order); i++ {
+		assert.True(t, times[order[i-1]].Before(times[order[i]]), order[i])
+	}
+}
+
+func TestBatchMaxConnsPerHost(t *testing.T) {
+	var open, maxOpen int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("{}"))
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			n := atomic.AddInt32(&open, 1)
+			for {
+				max := atomic.LoadInt32(&maxOpen)
+				if n <= max || atomic.CompareAndSwapInt32(&maxOpen, max, n) {
+					break
+				}
+			}
+		case http.StateClosed, http.StateHijacked:
+			atomic.AddInt32(&open, -1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, nil, MaxConnsPerHostOption(2))
+	go s.listenTasks()
+
+	var batch []httpRequest
+	for i := 0; i < 20; i++ {
+		batch = append(batch, httpRequest{URL: fmt.Sprintf("%s/%d", ts.URL, i)})
+	}
+	reply := execTestTask(t, taskC, submitC, "batchExecute", httpBatchRequest{Batch: batch})
+
+	var out httpBatchResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, 20, out.Summary.Successes)
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxOpen), int32(2))
+	assert.Greater(t, atomic.LoadInt32(&maxOpen), int32(0))
+}
+
+func TestUpstreamHosts(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.URL.Query().Get("to"); target != "" {
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	assert.Nil(t, err)
+	ipURL := "http://127.0.0.1:" + port
+	hostURL := "http://localhost:" + port
+	redirectURL := func(from, to string) string {
+		return from + "/?to=" + url.QueryEscape(to)
+	}
+
+	tests := []struct {
+		name    string
+		option  Option
+		url     string
+		allowed bool
+	}{
+		{"allowed host", AllowedHostsOption([]string{"127.0.0.1"}), ipURL, true},
+		{"not allowed host", AllowedHostsOption([]string{"mesg.com"}), ipURL, false},
+		{"not denied host", DeniedHostsOption([]string{"localhost"}), ipURL, true},
+		{"denied host", DeniedHostsOption([]string{"localhost"}), hostURL, false},
+		{"private ip", BlockPrivateIPsOption(true), ipURL, false},
+		{"resolves to private ip", BlockPrivateIPsOption(true), hostURL, false},
+		{"resolves to denied ip", DeniedHostsOption([]string{"127.0.0.1"}), hostURL, false},
+		{"redirect to allowed host", AllowedHostsOption([]string{"127.0.0.1"}), redirectURL(ipURL, ipURL), true},
+		{"redirect to not allowed host", AllowedHostsOption([]string{"127.0.0.1"}), redirectURL(ipURL, hostURL), false},
+		{"redirect to denied host", DeniedHostsOption([]string{"localhost"}), redirectURL(ipURL, hostURL), false},
+		{"redirect to denied ip", DeniedHostsOption([]string{"127.0.0.1"}), redirectURL(hostURL, ipURL), false},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&hits, 0)
+		taskC := make(chan *service.TaskData, 0)
+		submitC := make(chan *service.SubmitResultRequest, 0)
+		s := newTestService(t, &testClient{
+			stream:  &taskDataStream{taskC: taskC},
+			emitC:   make(chan *service.EmitEventRequest, 1),
+			submitC: submitC,
+		}, nil, tt.option)
+		go s.listenTasks()
+
+		reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: tt.url, Method: "GET"})
+		if tt.allowed {
+			assert.Equal(t, "success", reply.OutputKey, tt.name)
+			assert.Equal(t, int32(1), atomic.LoadInt32(&hits), tt.name)
+			continue
+		}
+		assert.Equal(t, "error", reply.OutputKey, tt.name)
+		var out httpErrorResponse
+		assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+		assert.Contains(t, out.Message, "is not allowed", tt.name)
+		assert.Equal(t, "host", out.Kind, tt.name)
+		assert.Equal(t, int32(0), atomic.LoadInt32(&hits), tt.name)
+	}
+}
+
+func TestExecuteMaxResponseBytes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":"0123456789"}`))
+	}))
+	defer ts.Close()
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, nil, MaxResponseBytesOption(1024))
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: ts.URL})
+	assert.Equal(t, "success", reply.OutputKey)
+
+	reply = execTestTask(t, taskC, submitC, "execute", httpRequest{URL: ts.URL, MaxResponseBytes: 10})
+	assert.Equal(t, "error", reply.OutputKey)
+	var out httpErrorResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, "response body exceeds the limit of 10 bytes", out.Message)
+	assert.Equal(t, http.StatusOK, out.StatusCode)
+}
+
+func TestResponseCache(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		fmt.Fprintf(w, `{"n":%d}`, n)
+	}))
+	defer ts.Close()
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, nil, ResponseCacheOption(time.Minute, 10))
+	go s.listenTasks()
+
+	for _, tt := range []struct {
+		req  httpRequest
+		n    float64
+		hits int32
+	}{
+		{httpRequest{URL: ts.URL, Method: "GET"}, 1, 1},
+		{httpRequest{URL: ts.URL, Method: "GET", Timeout: 1000}, 1, 1},
+		{httpRequest{URL: ts.URL, Method: "GET", Username: "user"}, 2, 2},
+		{httpRequest{URL: ts.URL + "/other", Method: "GET"}, 3, 3},
+		{httpRequest{URL: ts.URL}, 4, 4},
+		{httpRequest{URL: ts.URL}, 5, 5},
+	} {
+		reply := execTestTask(t, taskC, submitC, "execute", tt.req)
+		assert.Equal(t, "success", reply.OutputKey)
+		var out httpSuccessResponse
+		assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+		assert.Equal(t, map[string]interface{}{"n": tt.n}, out.Body)
+		assert.Equal(t, tt.hits, atomic.LoadInt32(&hits))
+	}
+}
+
+func TestExecuteFallbackURL(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("down"))
+	}))
+	defer primary.Close()
+	var fallbackHits int32
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fallbackHits, 1)
+		io.Copy(w, r.Body)
+	}))
+	defer fallback.Close()
+
+	taskC := make(chan *service.TaskData, 0)
+	emitC := make(chan *service.EmitEventRequest, 4)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   emitC,
+		submitC: submitC,
+	}, nil, DeniedHostsOption([]string{"localhost"}))
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "execute", httpRequest{
+		URL:         primary.URL,
+		FallbackURL: fallback.URL,
+		Body:        map[string]interface{}{"a": "b"},
+	})
+	assert.Equal(t, "success", reply.OutputKey)
+	var out httpSuccessResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, fallback.URL, out.URL)
+	assert.Equal(t, map[string]interface{}{"a": "b"}, out.Body)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fallbackHits))
+
+	// the failure of the primary url isn't reported when the fallback succeeds.
+	assert.Len(t, emitC, 0)
+	assert.Equal(t, int64(0), s.Stats().UpstreamErrors)
+
+	// the fallback is not used when the request succeeds.
+	reply = execTestTask(t, taskC, submitC, "execute", httpRequest{
+		URL:         fallback.URL,
+		FallbackURL: primary.URL,
+	})
+	assert.Equal(t, "success", reply.OutputKey)
+	out = httpSuccessResponse{}
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, fallback.URL, out.URL)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fallbackHits))
+
+	// the failure is reported once when the fallback fails too.
+	reply = execTestTask(t, taskC, submitC, "execute", httpRequest{
+		URL:         primary.URL,
+		FallbackURL: primary.URL,
+	})
+	assert.Equal(t, "error", reply.OutputKey)
+	assert.Len(t, emitC, 1)
+	assert.Equal(t, "onError", (<-emitC).EventKey)
+	assert.Equal(t, int64(1), s.Stats().UpstreamErrors)
+
+	// requests refused by the host policy aren't sent to the fallback.
+	_, port, err := net.SplitHostPort(primary.Listener.Addr().String())
+	assert.Nil(t, err)
+	reply = execTestTask(t, taskC, submitC, "execute", httpRequest{
+		URL:         "http://localhost:" + port,
+		FallbackURL: fallback.URL,
+	})
+	assert.Equal(t, "error", reply.OutputKey)
+	assert.Contains(t, reply.OutputData, "is not allowed")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fallbackHits))
+}
+
+func TestValidateURLs(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 5),
+		submitC: submitC,
+	}, nil, ValidateURLsOption(true))
+	go s.listenTasks()
+
+	for _, test := range []struct {
+		url     string
+		message string
+	}{
+		{"", `invalid url "": url is empty`},
+		{"mesg.com/path", `invalid url "mesg.com/path": scheme must be http or https`},
+		{"ftp://mesg.com", `invalid url "ftp://mesg.com": scheme must be http or https`},
+		{"http:///path", `invalid url "http:///path": host is missing`},
+		{"http://mesg.com:port", `invalid url "http://mesg.com:port": invalid port ":port" after host`},
+	} {
+		reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: test.url})
+		assert.Equal(t, "error", reply.OutputKey)
+		var out httpErrorResponse
+		assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+		assert.Equal(t, test.message, out.Message)
+	}
+	assert.Empty(t, paths)
+
+	reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: " " + strings.ToUpper(ts.URL) + "/Path "})
+	assert.Equal(t, "success", reply.OutputKey)
+	assert.Equal(t, []string{"/Path"}, paths)
+}
+
+func TestExecuteURLs(t *testing.T) {
+	bodyC := make(chan string, 3)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		bodyC <- string(data)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("bad gateway"))
+			return
+		}
+		fmt.Fprintf(w, `{"path":%q}`, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "execute", httpRequest{
+		URLs: []string{ts.URL + "/a", ts.URL + "/b", ts.URL + "/fail"},
+		Body: map[string]interface{}{"a": "b"},
+	})
+	assert.Equal(t, "batch", reply.OutputKey)
+	var out httpBatchResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, 3, out.Summary.Total)
+	assert.Equal(t, map[string]interface{}{"path": "/a"}, out.Batch.Successes[ts.URL+"/a"].Body)
+	assert.Equal(t, map[string]interface{}{"path": "/b"}, out.Batch.Successes[ts.URL+"/b"].Body)
+	assert.Equal(t, http.StatusBadGateway, out.Batch.Errors[ts.URL+"/fail"].StatusCode)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, `{"a":"b"}`, <-bodyC)
+	}
+
+	reply = execTestTask(t, taskC, submitC, "execute", httpRequest{
+		URL:  ts.URL + "/a",
+		URLs: []string{ts.URL + "/b"},
+	})
+	assert.Equal(t, "error", reply.OutputKey)
+	assert.Contains(t, reply.OutputData, "url and urls can't be set together")
+
+	// single url requests are replied as before.
+	reply = execTestTask(t, taskC, submitC, "execute", httpRequest{URL: ts.URL + "/a"})
+	assert.Equal(t, "success", reply.OutputKey)
+	<-bodyC
+}
+
+func TestBatchDeadline(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, &testWebhooklessApp{wm}, BatchDeadlineOption(time.Millisecond*100))
+	go s.listenTasks()
+
+	start := time.Now()
+	reply := execTestTask(t, taskC, submitC, "batchExecute", httpBatchRequest{
+		Batch: []httpRequest{
+			{URL: ts.URL + "/1"},
+			{URL: ts.URL + "/2"},
+			{URL: ts.URL + "/slow"},
+		},
+	})
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, "batch", reply.OutputKey)
+
+	var out httpBatchResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Len(t, out.Batch.Successes, 2)
+	assert.Len(t, out.Batch.Errors, 1)
+	assert.Contains(t, out.Batch.Errors[ts.URL+"/slow"].Message, "deadline")
+	assert.Equal(t, "timeout", out.Batch.Errors[ts.URL+"/slow"].Kind)
+	assert.Equal(t, 2, out.Summary.Successes)
+	assert.Equal(t, 1, out.Summary.Errors)
+	assert.InDelta(t, out.Summary.TotalDuration/2, out.Summary.AvgDuration, 0.001)
+}
+
+func TestGlobalConcurrency(t *testing.T) {
+	var inflight, peak int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 20)
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		submitC: submitC,
+	}, &testWebhooklessApp{wm}, GlobalConcurrencyOption(2))
+	go s.listenTasks()
+
+	for i := 0; i < 2; i++ {
+		var batch []httpRequest
+		for j := 0; j < 4; j++ {
+			batch = append(batch, httpRequest{URL: fmt.Sprintf("%s/%d/%d", ts.URL, i, j)})
+		}
+		input, err := json.Marshal(httpBatchRequest{Batch: batch})
+		assert.Nil(t, err)
+		taskC <- &service.TaskData{
+			ExecutionID: strconv.Itoa(i),
+			TaskKey:     "batchExecute",
+			InputData:   string(input),
+		}
+	}
+	for i := 0; i < 2; i++ {
+		reply := <-submitC
+		var out httpBatchResponse
+		assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+		assert.Equal(t, 4, out.Summary.Successes)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&peak))
+}
+
+func TestDryRun(t *testing.T) {
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	tw := &testWebman{err: errors.New("unexpected request")}
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		submitC: submitC,
+	}, tw, DryRunOption(true))
+	go s.listenTasks()
+
+	body := map[string]interface{}{"name": "test"}
+	reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: "http://mesg.com", Body: body})
+	assert.Equal(t, "success", reply.OutputKey)
+	var out httpSuccessResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, http.StatusOK, out.StatusCode)
+	assert.Equal(t, body, out.Body)
+
+	reply = execTestTask(t, taskC, submitC, "batchExecute", httpBatchRequest{
+		Batch: []httpRequest{{URL: "http://mesg.com"}, {URL: "http://mesg.io"}},
+	})
+	assert.Equal(t, "batch", reply.OutputKey)
+	var batchOut httpBatchResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &batchOut))
+	assert.Equal(t, 2, batchOut.Summary.Successes)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&tw.calls))
+}
+
+func TestDisableWebhook(t *testing.T) {
+	srv, err := mesg.NewService(
+		mesg.ServiceTokenOption(token),
+		mesg.ServiceEndpointOption(endpoint),
+	)
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	srv.Client = &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		submitC: submitC,
+	}
+	tw := &testWebman{
+		payload:    map[string]interface{}{},
+		statusCode: http.StatusOK,
+		startC:     make(chan struct{}, 1),
+	}
+
+	s, err := New(
+		LogOutputOption(ioutil.Discard),
+		DisableWebhookOption(),
+		mesgServiceOption(srv),
+		applicationServiceOption(tw),
+	)
+	assert.Nil(t, err)
+
+	go s.Start()
+
+	reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: "http://mesg.com"})
+	assert.Equal(t, "success", reply.OutputKey)
+	assert.Equal(t, 0, len(tw.startC))
+
+	_, err = New(
+		LogOutputOption(ioutil.Discard),
+		DisableWebhookOption(),
+		WebhookOption("test", "test"),
+	)
+	assert.NotNil(t, err)
+}
+
+func TestDisableTasks(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 0)
+	client := &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, client, tw, DisableTasksOption())
+
+	go s.Start()
+	<-tw.startC
+
+	req, err := http.NewRequest("POST", "", bytes.NewBufferString(`{}`))
 	assert.Nil(t, err)
+	go tw.webhookHandler(req)
+	ed := <-emitC
+	assert.Equal(t, "onRequest", ed.EventKey)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&client.listenCount))
+
+	_, err = New(
+		LogOutputOption(ioutil.Discard),
+		DisableWebhookOption(),
+		DisableTasksOption(),
+	)
+	assert.NotNil(t, err)
+}
 
+func TestCloseWithoutStart(t *testing.T) {
 	srv, err := mesg.NewService(
 		mesg.ServiceTokenOption(token),
 		mesg.ServiceEndpointOption(endpoint),
 	)
 	assert.Nil(t, err)
-	assert.NotNil(t, srv)
 
+	s, err := New(
+		LogOutputOption(ioutil.Discard),
+		WebhookOption("test", "test"),
+		mesgServiceOption(srv),
+	)
+	assert.Nil(t, err)
+	assert.NotPanics(t, func() { assert.Nil(t, s.Close()) })
+}
+
+func TestStartReturnsNilOnClose(t *testing.T) {
+	taskC := make(chan *service.TaskData, 0)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		stream: &taskDataStream{taskC: taskC},
+	}, tw)
+
+	errC := make(chan error)
+	go func() { errC <- s.Start() }()
+	<-tw.startC
+
+	assert.Nil(t, s.Close())
+	// closing the connection makes task stream fail.
+	close(taskC)
+	assert.Nil(t, <-errC)
+	assert.Nil(t, s.Close())
+}
+
+func TestStartReturnsError(t *testing.T) {
+	taskC := make(chan *service.TaskData, 0)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		stream: &taskDataStream{taskC: taskC},
+	}, tw)
+
+	errC := make(chan error)
+	go func() { errC <- s.Start() }()
+	<-tw.startC
+
+	close(taskC)
+	assert.Equal(t, errClosedConn, <-errC)
+}
+
+func TestReconnect(t *testing.T) {
 	taskC := make(chan *service.TaskData, 0)
+	tw := &testWebman{
+		startC:     make(chan struct{}, 0),
+		payload:    map[string]interface{}{},
+		statusCode: http.StatusOK,
+	}
+
+	reconnectC := make(chan chan *service.TaskData, 1)
 	submitC := make(chan *service.SubmitResultRequest, 0)
-	srv.Client = &testClient{
+	newService := func() (*mesg.Service, error) {
+		srv, err := mesg.NewService(
+			mesg.ServiceTokenOption(token),
+			mesg.ServiceEndpointOption(endpoint),
+		)
+		if err != nil {
+			return nil, err
+		}
+		taskC := make(chan *service.TaskData, 0)
+		srv.Client = &testClient{
+			stream:  &taskDataStream{taskC: taskC},
+			submitC: submitC,
+		}
+		reconnectC <- taskC
+		return srv, nil
+	}
+
+	s := newTestService(t, &testClient{
+		stream: &taskDataStream{taskC: taskC},
+	}, tw,
+		ReconnectOption(true, time.Millisecond*10),
+		mesgServiceFactoryOption(newService),
+	)
+
+	errC := make(chan error)
+	go func() { errC <- s.Start() }()
+	<-tw.startC
+
+	close(taskC)
+	taskC = <-reconnectC
+
+	reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: "http://mesg.com"})
+	assert.Equal(t, "success", reply.OutputKey)
+
+	s.listenM.Lock()
+	assert.NotNil(t, s.listenService)
+	s.listenM.Unlock()
+
+	assert.Nil(t, s.Close())
+	assert.Nil(t, <-errC)
+
+	s.listenM.Lock()
+	assert.Nil(t, s.listenService)
+	s.listenM.Unlock()
+
+	for _, backoff := range []time.Duration{0, -time.Second} {
+		_, err := New(
+			LogOutputOption(ioutil.Discard),
+			WebhookOption("test", "test"),
+			ReconnectOption(true, backoff),
+		)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestBatchMalformedInput(t *testing.T) {
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	tw := &testWebman{
+		payload:    map[string]interface{}{},
+		statusCode: http.StatusOK,
+	}
+	s := newTestService(t, &testClient{
 		stream:  &taskDataStream{taskC: taskC},
 		submitC: submitC,
+	}, tw)
+	go s.listenTasks()
+
+	tests := []struct {
+		input   string
+		message string
+	}{
+		{`{"batch":`, "err while decoding batch input data"},
+		{`{}`, "batch field is missing"},
+		{`{"batch":null}`, "batch field is missing"},
+		{`{"batch":{"url":"http://mesg.com"}}`, "batch must be an array of requests"},
+		{`{"batch":[]}`, "batch is empty"},
 	}
+	for _, test := range tests {
+		taskC <- &service.TaskData{
+			ExecutionID: "executionID",
+			TaskKey:     "batchExecute",
+			InputData:   test.input,
+		}
+		reply := <-submitC
+		assert.Equal(t, "error", reply.OutputKey)
+		var out httpErrorResponse
+		assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+		assert.True(t, strings.HasPrefix(out.Message, test.message), out.Message)
+	}
+
+	reply := execTestTask(t, taskC, submitC, "batchExecute", httpBatchRequest{
+		Batch: []httpRequest{{URL: "http://mesg.com"}},
+	})
+	assert.Equal(t, "batch", reply.OutputKey)
+}
+
+func TestEnabledTasks(t *testing.T) {
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
 	tw := &testWebman{
-		payload:    postPayload,
-		statusCode: statusCode,
-		startC:     make(chan struct{}, 0),
+		payload:    map[string]interface{}{},
+		statusCode: http.StatusOK,
 	}
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		submitC: submitC,
+	}, tw, EnableBatchOption(false))
+	go s.listenTasks()
 
-	s, err := New(
+	batchInput, err := json.Marshal(httpBatchRequest{Batch: []httpRequest{{URL: "http://mesg.com"}}})
+	assert.Nil(t, err)
+	taskC <- &service.TaskData{
+		ExecutionID: "batch",
+		TaskKey:     "batchExecute",
+		InputData:   string(batchInput),
+	}
+	executeInput, err := json.Marshal(httpRequest{URL: "http://mesg.com"})
+	assert.Nil(t, err)
+	taskC <- &service.TaskData{
+		ExecutionID: "execute",
+		TaskKey:     "execute",
+		InputData:   string(executeInput),
+	}
+
+	reply := <-submitC
+	assert.Equal(t, "execute", reply.ExecutionID)
+	select {
+	case reply := <-submitC:
+		t.Fatalf("unexpected reply for %s", reply.ExecutionID)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	_, err = New(
 		LogOutputOption(ioutil.Discard),
 		WebhookOption("test", "test"),
-		mesgServiceOption(srv),
-		applicationServiceOption(tw),
+		EnableExecuteOption(false),
+		EnableBatchOption(false),
+	)
+	assert.NotNil(t, err)
+}
+
+func TestHealthTask(t *testing.T) {
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	emitErr := errors.New("unavailable")
+	client := &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}
+	s := newTestService(t, client, nil,
+		WebhookOption("/webhook", "127.0.0.1:0"),
+		HealthTaskOption(),
 	)
+	wm := s.webman.(*webman.Webman)
+	go s.Start()
+	defer s.Close()
+	<-wm.Ready()
+
+	time.Sleep(time.Millisecond * 10)
+	reply := execTestTask(t, taskC, submitC, "health", nil)
+	assert.Equal(t, "health", reply.OutputKey)
+	var out healthResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, healthStatusHealthy, out.Status)
+	assert.True(t, out.Webhook)
+	assert.True(t, out.Mesg)
+	assert.True(t, out.Uptime > 0)
+
+	client.emitErr = func() error { return emitErr }
+	assert.Equal(t, emitErr, s.InjectWebhook("test"))
+	reply = execTestTask(t, taskC, submitC, "health", nil)
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, healthStatusUnhealthy, out.Status)
+	assert.False(t, out.Mesg)
+}
+
+func TestWebhookGzipBody(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 1)
+	s := newTestService(t, &testClient{
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+		emitC:  emitC,
+	}, nil, WebhookOption("/webhook", "127.0.0.1:0"))
+	wm := s.webman.(*webman.Webman)
+	go s.Start()
+	defer s.Close()
+	<-wm.Ready()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write([]byte(`{"event":"paid"}`))
 	assert.Nil(t, err)
-	assert.NotNil(t, s)
+	assert.Nil(t, gw.Close())
+
+	_, port, err := net.SplitHostPort(wm.WebhookAddr())
+	assert.Nil(t, err)
+	req, err := http.NewRequest("POST", "http://127.0.0.1:"+port+"/webhook", &buf)
+	assert.Nil(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	var out Event
+	assert.Nil(t, json.Unmarshal([]byte((<-emitC).EventData), &out))
+	assert.Equal(t, map[string]interface{}{"event": "paid"}, out.Body)
+}
+
+func TestShutdownTask(t *testing.T) {
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, tw, ShutdownTaskOption("secret"))
+	errC := make(chan error, 1)
+	go func() { errC <- s.Start() }()
+	<-tw.startC
+
+	for _, input := range []interface{}{shutdownRequest{Token: "wrong"}, shutdownRequest{}, "secret"} {
+		reply := execTestTask(t, taskC, submitC, "shutdown", input)
+		assert.Equal(t, "error", reply.OutputKey)
+		assert.Contains(t, reply.OutputData, "invalid shutdown token")
+	}
+	select {
+	case <-s.closeC:
+		t.Fatal("service is closed without the shutdown token")
+	default:
+	}
+
+	reply := execTestTask(t, taskC, submitC, "shutdown", shutdownRequest{Token: "secret"})
+	assert.Equal(t, "shutdown", reply.OutputKey)
+	select {
+	case err := <-errC:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("service is not closed")
+	}
+}
+
+func TestWebhookConfig(t *testing.T) {
+	s := newTestService(t, &testClient{
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+		emitC:  make(chan *service.EmitEventRequest, 1),
+	}, nil,
+		WebhookOption("/webhook", "127.0.0.1:0"),
+		WebhookSchemaOption([]byte(`{"type":"object"}`)),
+		WebhookDedupHeaderOption("X-Delivery-ID"),
+		WebhookTimestampOption("X-Timestamp", time.Minute),
+		WebhookHeadersOption("User-Agent"),
+	)
+	assert.Equal(t, WebhookConfig{
+		Enabled:            true,
+		Endpoint:           "/webhook",
+		Addr:               "127.0.0.1:0",
+		Schema:             true,
+		DedupHeader:        "X-Delivery-ID",
+		TimestampHeader:    "X-Timestamp",
+		TimestampTolerance: time.Minute,
+		Headers:            []string{"User-Agent"},
+	}, s.WebhookConfig())
+
+	wm := s.webman.(*webman.Webman)
+	go s.Start()
+	defer s.Close()
+	<-wm.Ready()
+	assert.Equal(t, wm.WebhookAddr(), s.WebhookConfig().ListenAddr)
+	assert.NotEmpty(t, s.WebhookConfig().ListenAddr)
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	emitC := make(chan *service.EmitEventRequest, 2)
+	tw := &testWebman{startC: make(chan struct{}, 0)}
+	s := newTestService(t, &testClient{
+		emitC:  emitC,
+		stream: &taskDataStream{taskC: make(chan *service.TaskData, 0)},
+	}, tw, LifecycleEventsOption(true), VersionOption("1.2.3"))
+	now := time.Now()
+	s.now = func() time.Time { return now }
 
 	go s.Start()
+	<-tw.startC
 
-	taskC <- &service.TaskData{
-		ExecutionID: executionID,
-		TaskKey:     taskKey,
-		InputData:   string(inputDataBytes),
+	ed := <-emitC
+	assert.Equal(t, "onStart", ed.EventKey)
+	var out lifecycleEvent
+	assert.Nil(t, json.Unmarshal([]byte(ed.EventData), &out))
+	assert.Equal(t, lifecycleEvent{Version: "1.2.3"}, out)
+
+	now = now.Add(time.Minute)
+	assert.Nil(t, s.Close())
+	ed = <-emitC
+	assert.Equal(t, "onStop", ed.EventKey)
+	assert.Nil(t, json.Unmarshal([]byte(ed.EventData), &out))
+	assert.Equal(t, lifecycleEvent{Version: "1.2.3", Uptime: 60}, out)
+}
+
+func TestStats(t *testing.T) {
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	tw := &testWebman{
+		startC:     make(chan struct{}, 0),
+		payload:    map[string]interface{}{},
+		statusCode: http.StatusOK,
 	}
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 10),
+		submitC: submitC,
+	}, tw)
+	go s.Start()
+	<-tw.startC
 
-	reply := <-submitC
-	assert.Equal(t, "success", reply.OutputKey)
-	var out httpSuccessResponse
-	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
-	assert.Equal(t, statusCode, out.StatusCode)
-	assert.Equal(t, postPayload, out.Body)
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("", "", bytes.NewBufferString(`{"body":"test"}`))
+		assert.Nil(t, err)
+		assert.Nil(t, tw.webhookHandler(req))
+	}
+	execTestTask(t, taskC, submitC, "execute", httpRequest{URL: "http://mesg.com"})
+	execTestTask(t, taskC, submitC, "batchExecute", httpBatchRequest{
+		Batch: []httpRequest{{URL: "http://mesg.com"}, {URL: "http://mesg.io"}},
+	})
+	tw.err = errors.New("failed")
+	execTestTask(t, taskC, submitC, "execute", httpRequest{URL: "http://mesg.com"})
 
-	taskC <- &service.TaskData{
-		ExecutionID: executionID,
-		TaskKey:     taskBatchKey,
-		InputData:   string(inputDataBatchBytes),
+	assert.Equal(t, Stats{
+		WebhookRequests:  2,
+		TasksExecuted:    2,
+		BatchesProcessed: 1,
+		UpstreamErrors:   1,
+	}, s.Stats())
+}
+
+func TestCustomKeys(t *testing.T) {
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	tw := &testWebman{
+		payload:    map[string]interface{}{},
+		statusCode: http.StatusOK,
 	}
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, tw,
+		TaskKeysOption("post", "postMany"),
+		OutputKeysOption("ok", "failed", "results"),
+	)
+	go s.listenTasks()
 
-	reply = <-submitC
-	assert.Equal(t, "batch", reply.OutputKey)
-	var outBatch httpBatchResponse
-	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &outBatch))
-	assert.Equal(t, len(inputDataBatch.Batch), len(outBatch.Batch.Successes))
-	for _, data := range inputDataBatch.Batch {
-		assert.Equal(t, statusCode, outBatch.Batch.Successes[data.URL].StatusCode)
-		assert.Equal(t, postPayload, outBatch.Batch.Successes[data.URL].Body)
+	reply := execTestTask(t, taskC, submitC, "post", httpRequest{URL: "http://mesg.com"})
+	assert.Equal(t, "ok", reply.OutputKey)
+
+	reply = execTestTask(t, taskC, submitC, "postMany", httpBatchRequest{
+		Batch: []httpRequest{{URL: "http://mesg.com"}},
+	})
+	assert.Equal(t, "results", reply.OutputKey)
+
+	tw.err = errors.New("failed")
+	reply = execTestTask(t, taskC, submitC, "post", httpRequest{URL: "http://mesg.com"})
+	assert.Equal(t, "failed", reply.OutputKey)
+}
+
+// newTestService creates a Service that uses client to communicate with mesg and app for http calls.
+func newTestService(t *testing.T, client *testClient, app Application, options ...Option) *Service {
+	srv, err := mesg.NewService(
+		mesg.ServiceTokenOption(token),
+		mesg.ServiceEndpointOption(endpoint),
+	)
+	assert.Nil(t, err)
+	srv.Client = client
+
+	options = append([]Option{
+		LogOutputOption(ioutil.Discard),
+		WebhookOption("test", "test"),
+		mesgServiceOption(srv),
+		applicationServiceOption(app),
+	}, options...)
+	s, err := New(options...)
+	assert.Nil(t, err)
+	return s
+}
+
+// execTestTask sends a task with input data and returns its reply.
+func execTestTask(t *testing.T, taskC chan *service.TaskData, submitC chan *service.SubmitResultRequest,
+	key string, input interface{}) *service.SubmitResultRequest {
+	inputBytes, err := json.Marshal(input)
+	assert.Nil(t, err)
+	taskC <- &service.TaskData{
+		ExecutionID: "executionID",
+		TaskKey:     key,
+		InputData:   string(inputBytes),
 	}
+	return <-submitC
 }
 
 type testServiceProvider struct {
@@ -197,14 +3301,21 @@ type testWebman struct {
 	webhookEndpoint string
 	webhookAddr     string
 	webhookHandler  func(*http.Request) error
+	err             error
+
+	// calls is the number of requests made.
+	calls int32
 }
 
-func (tw *testWebman) Post(url string, data, out interface{}) (statusCode int, err error) {
-	bytes, err := json.Marshal(tw.payload)
-	if err != nil {
-		return statusCode, err
+func (tw *testWebman) Do(ctx context.Context, req *webman.Request) (*webman.Response, error) {
+	atomic.AddInt32(&tw.calls, 1)
+	resp := &webman.Response{StatusCode: tw.statusCode}
+	if tw.err != nil {
+		return resp, tw.err
 	}
-	return tw.statusCode, json.Unmarshal(bytes, out)
+	body, err := json.Marshal(tw.payload)
+	resp.Body = body
+	return resp, err
 }
 
 func (tw *testWebman) StartWebhook(endpoint, addr string, h func(*http.Request) error) error {
@@ -217,14 +3328,156 @@ func (tw *testWebman) StartWebhook(endpoint, addr string, h func(*http.Request)
 
 func (tw *testWebman) ShutdownWebhook() {}
 
+func TestBatchErrorKinds(t *testing.T) {
+	dialErr := func(err error) error {
+		return &webman.TransportError{Err: &url.Error{
+			Op:  "Post",
+			URL: "http://mesg.com",
+			Err: &net.OpError{Op: "dial", Net: "tcp", Err: err},
+		}}
+	}
+	doer := &urlDoer{
+		errors: map[string]error{
+			"http://timeout": &webman.TransportError{Err: &url.Error{
+				Op:  "Post",
+				URL: "http://timeout",
+				Err: context.DeadlineExceeded,
+			}},
+			"http://dns":     dialErr(&net.DNSError{Err: "no such host", Name: "dns"}),
+			"http://lookup":  &net.DNSError{Err: "no such host", Name: "lookup"},
+			"http://refused": dialErr(os.NewSyscallError("connect", syscall.ECONNREFUSED)),
+			"http://reset":   dialErr(os.NewSyscallError("read", syscall.ECONNRESET)),
+		},
+		responses: map[string]*webman.Response{
+			"http://decode": {StatusCode: http.StatusOK, Body: []byte("not json")},
+			"http://status": {StatusCode: http.StatusBadGateway, Body: []byte("bad gateway")},
+		},
+	}
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 7),
+		submitC: submitC,
+	}, &testWebman{}, HTTPDoerOption(doer))
+	go s.listenTasks()
+
+	kinds := map[string]string{
+		"http://timeout": "timeout",
+		"http://dns":     "dns",
+		"http://lookup":  "dns",
+		"http://refused": "connection_refused",
+		"http://reset":   "connection",
+		"http://decode":  "decode",
+		"http://status":  "status",
+	}
+	var batch httpBatchRequest
+	for url := range kinds {
+		batch.Batch = append(batch.Batch, httpRequest{URL: url})
+	}
+	reply := execTestTask(t, taskC, submitC, "batchExecute", batch)
+	assert.Equal(t, "batch", reply.OutputKey)
+
+	var out httpBatchResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Len(t, out.Batch.Errors, len(kinds))
+	for url, kind := range kinds {
+		assert.Equal(t, kind, out.Batch.Errors[url].Kind, url)
+	}
+}
+
+func TestExecuteErrorKind(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Close()
+
+	wm, err := webman.New(webman.LoggerOption(log.New(ioutil.Discard, "", 0)))
+	assert.Nil(t, err)
+
+	taskC := make(chan *service.TaskData, 0)
+	submitC := make(chan *service.SubmitResultRequest, 0)
+	s := newTestService(t, &testClient{
+		stream:  &taskDataStream{taskC: taskC},
+		emitC:   make(chan *service.EmitEventRequest, 1),
+		submitC: submitC,
+	}, &testWebhooklessApp{wm})
+	go s.listenTasks()
+
+	reply := execTestTask(t, taskC, submitC, "execute", httpRequest{URL: ts.URL})
+	assert.Equal(t, "error", reply.OutputKey)
+	var out httpErrorResponse
+	assert.Nil(t, json.Unmarshal([]byte(reply.OutputData), &out))
+	assert.Equal(t, "connection_refused", out.Kind)
+}
+
+// testDoer replies requests with its responses in order and records them.
+type testDoer struct {
+	responses []*webman.Response
+	requests  []*webman.Request
+	deadlines []time.Time
+	m         sync.Mutex
+}
+
+func (d *testDoer) Do(ctx context.Context, req *webman.Request) (*webman.Response, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	deadline, _ := ctx.Deadline()
+	d.requests = append(d.requests, req)
+	d.deadlines = append(d.deadlines, deadline)
+	resp := d.responses[0]
+	d.responses = d.responses[1:]
+	return resp, nil
+}
+
+// urlDoer replies requests with the errors or responses of their urls.
+type urlDoer struct {
+	errors    map[string]error
+	responses map[string]*webman.Response
+}
+
+func (d *urlDoer) Do(ctx context.Context, req *webman.Request) (*webman.Response, error) {
+	if err, ok := d.errors[req.URL]; ok {
+		return nil, err
+	}
+	return d.responses[req.URL], nil
+}
+
+// testWebhooklessApp uses a real Webman for requests but never starts a webhook server.
+type testWebhooklessApp struct {
+	*webman.Webman
+}
+
+func (a *testWebhooklessApp) StartWebhook(endpoint, addr string, h func(*http.Request) error) error {
+	return nil
+}
+
+func (a *testWebhooklessApp) ShutdownWebhook() {}
+
 type testClient struct {
 	stream  service.Service_ListenTaskClient
 	emitC   chan *service.EmitEventRequest
 	submitC chan *service.SubmitResultRequest
+
+	listenCount int32
+
+	// emitErr returns the error of EmitEvent calls when set.
+	emitErr func() error
+
+	// inProgress counts the received executions of tasks that aren't completed.
+	// Results of other executions are rejected like core does because it completes
+	// executions with their first results.
+	inProgress      map[string]int
+	rejectedResults int32
+	m               sync.Mutex
 }
 
 func (t *testClient) EmitEvent(ctx context.Context, in *service.EmitEventRequest,
 	opts ...grpc.CallOption) (*service.EmitEventReply, error) {
+	if t.emitErr != nil {
+		if err := t.emitErr(); err != nil {
+			return nil, err
+		}
+	}
 	t.emitC <- in
 	return nil, nil
 }
@@ -232,16 +3485,48 @@ func (t *testClient) EmitEvent(ctx context.Context, in *service.EmitEventRequest
 func (t *testClient) ListenTask(ctx context.Context,
 	in *service.ListenTaskRequest,
 	opts ...grpc.CallOption) (service.Service_ListenTaskClient, error) {
-	return t.stream, nil
+	atomic.AddInt32(&t.listenCount, 1)
+	if t.stream == nil {
+		return nil, nil
+	}
+	return &trackedTaskStream{Service_ListenTaskClient: t.stream, client: t}, nil
 }
 
 func (t *testClient) SubmitResult(ctx context.Context,
 	in *service.SubmitResultRequest,
 	opts ...grpc.CallOption) (*service.SubmitResultReply, error) {
+	t.m.Lock()
+	if t.inProgress[in.ExecutionID] == 0 {
+		t.m.Unlock()
+		atomic.AddInt32(&t.rejectedResults, 1)
+		return nil, errors.New("No task in progress with the ID " + in.ExecutionID)
+	}
+	t.inProgress[in.ExecutionID]--
+	t.m.Unlock()
 	t.submitC <- in
 	return nil, nil
 }
 
+// trackedTaskStream marks the executions received from the stream as in progress.
+type trackedTaskStream struct {
+	service.Service_ListenTaskClient
+	client *testClient
+}
+
+func (s *trackedTaskStream) Recv() (*service.TaskData, error) {
+	data, err := s.Service_ListenTaskClient.Recv()
+	if err != nil {
+		return nil, err
+	}
+	s.client.m.Lock()
+	if s.client.inProgress == nil {
+		s.client.inProgress = map[string]int{}
+	}
+	s.client.inProgress[data.ExecutionID]++
+	s.client.m.Unlock()
+	return data, nil
+}
+
 type taskDataStream struct {
 	taskC chan *service.TaskData
 	grpc.ClientStream
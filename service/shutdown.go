@@ -0,0 +1,41 @@
+package service
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+
+	mesg "github.com/ilgooz/mesg-go"
+)
+
+var errInvalidShutdownToken = errors.New("invalid shutdown token")
+
+type shutdownRequest struct {
+	Token string `json:"token"`
+}
+
+type shutdownResponse struct {
+	Message string `json:"message"`
+}
+
+// shutdownHandler closes the service after replying when the request has the shutdown token.
+func (s *Service) shutdownHandler(req *mesg.Request) {
+	var sreq shutdownRequest
+	if err := req.Get(&sreq); err != nil ||
+		subtle.ConstantTimeCompare([]byte(sreq.Token), []byte(s.shutdownToken)) != 1 {
+		if err := req.Reply(s.keys.errorOutput, httpErrorResponse{
+			Message: errInvalidShutdownToken.Error(),
+		}); err != nil {
+			log.Printf("error while reply: %s", err)
+		}
+		return
+	}
+
+	if err := req.Reply(s.keys.shutdownOutput, shutdownResponse{
+		Message: "service is shutting down",
+	}); err != nil {
+		log.Printf("error while reply: %s", err)
+	}
+	log.Printf("shutting down by the shutdown task")
+	go s.Close()
+}
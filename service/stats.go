@@ -0,0 +1,35 @@
+package service
+
+import "sync/atomic"
+
+// Stats is a snapshot of the service's runtime counters.
+type Stats struct {
+	// WebhookRequests is the number of received webhook requests.
+	WebhookRequests int64
+
+	// TasksExecuted is the number of executed execute tasks.
+	TasksExecuted int64
+
+	// BatchesProcessed is the number of processed batchExecute tasks.
+	BatchesProcessed int64
+
+	// UpstreamErrors is the number of failed upstream requests.
+	UpstreamErrors int64
+}
+
+type stats struct {
+	webhookRequests  int64
+	tasksExecuted    int64
+	batchesProcessed int64
+	upstreamErrors   int64
+}
+
+// Stats returns a snapshot of the runtime counters.
+func (s *Service) Stats() Stats {
+	return Stats{
+		WebhookRequests:  atomic.LoadInt64(&s.stats.webhookRequests),
+		TasksExecuted:    atomic.LoadInt64(&s.stats.tasksExecuted),
+		BatchesProcessed: atomic.LoadInt64(&s.stats.batchesProcessed),
+		UpstreamErrors:   atomic.LoadInt64(&s.stats.upstreamErrors),
+	}
+}
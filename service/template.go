@@ -0,0 +1,34 @@
+package service
+
+import "regexp"
+
+// templateVarRegexp matches the ${var} tokens of body templates.
+var templateVarRegexp = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// renderTemplate replaces the ${var} tokens in the strings of template with vars.
+// Tokens of unknown vars are kept as is.
+func renderTemplate(template interface{}, vars map[string]string) interface{} {
+	switch t := template.(type) {
+	case string:
+		return templateVarRegexp.ReplaceAllStringFunc(t, func(token string) string {
+			if value, ok := vars[token[2:len(token)-1]]; ok {
+				return value
+			}
+			return token
+		})
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for key, value := range t {
+			out[key] = renderTemplate(value, vars)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, value := range t {
+			out[i] = renderTemplate(value, vars)
+		}
+		return out
+	default:
+		return template
+	}
+}
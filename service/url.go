@@ -0,0 +1,42 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// urlError is the error of requests with invalid urls.
+type urlError struct {
+	url     string
+	problem string
+}
+
+func (e *urlError) Error() string {
+	return fmt.Sprintf("invalid url %q: %s", e.url, e.problem)
+}
+
+// normalizeURL validates rawurl to be an absolute http or https url and returns it
+// with the surrounding spaces trimmed and its scheme and host lower cased.
+func normalizeURL(rawurl string) (string, error) {
+	trimmed := strings.TrimSpace(rawurl)
+	if trimmed == "" {
+		return "", &urlError{url: rawurl, problem: "url is empty"}
+	}
+	u, err := url.Parse(trimmed)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return "", &urlError{url: rawurl, problem: err.Error()}
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", &urlError{url: rawurl, problem: "scheme must be http or https"}
+	}
+	if u.Host == "" {
+		return "", &urlError{url: rawurl, problem: "host is missing"}
+	}
+	u.Host = strings.ToLower(u.Host)
+	return u.String(), nil
+}
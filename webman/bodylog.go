@@ -0,0 +1,61 @@
+package webman
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// redactedValue replaces the values of redacted keys in logged bodies.
+const redactedValue = "[REDACTED]"
+
+// logBody logs body with the values of the debug redact keys masked.
+// Bodies that aren't json are not logged when there are redact keys since
+// they can't be redacted.
+func (w *Webman) logBody(format string, body []byte, args ...interface{}) {
+	args = append(args, w.redactBody(body))
+	w.log.Printf(format, args...)
+}
+
+func (w *Webman) redactBody(body []byte) string {
+	if len(w.debugRedactKeys) == 0 {
+		return string(body)
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Sprintf("<%d bytes of non json body>", len(body))
+	}
+	data, err := json.Marshal(w.redact(v))
+	if err != nil {
+		return fmt.Sprintf("<%d bytes of body>", len(body))
+	}
+	return string(data)
+}
+
+// redact masks the values of the redact keys in v recursively.
+func (w *Webman) redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for key, value := range t {
+			if w.isRedactKey(key) {
+				t[key] = redactedValue
+				continue
+			}
+			t[key] = w.redact(value)
+		}
+	case []interface{}:
+		for i, value := range t {
+			t[i] = w.redact(value)
+		}
+	}
+	return v
+}
+
+func (w *Webman) isRedactKey(key string) bool {
+	for _, k := range w.debugRedactKeys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
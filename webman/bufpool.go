@@ -0,0 +1,85 @@
+package webman
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPooledBufferSize is the max capacity of buffers kept in the pool so a few
+// large bodies don't hold on to memory.
+const maxPooledBufferSize = 1 << 16
+
+// bufferPool reuses the buffers that request bodies are marshaled into.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool() *bufferPool {
+	return &bufferPool{pool: sync.Pool{
+		New: func() interface{} { return new(bytes.Buffer) },
+	}}
+}
+
+// marshal encodes v as json into a buffer of the pool.
+// The buffer must be released when it's not needed anymore.
+func (p *bufferPool) marshal(v interface{}) (*pooledBuffer, error) {
+	buf := p.pool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		p.put(buf)
+		return nil, err
+	}
+	// drop the newline added by the encoder to send the same body as json.Marshal.
+	buf.Truncate(buf.Len() - 1)
+	return &pooledBuffer{pool: p, buf: buf, refs: 1}, nil
+}
+
+func (p *bufferPool) put(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	p.pool.Put(buf)
+}
+
+// pooledBuffer is a buffer that goes back to its pool once it's released
+// by its owner and all of its readers are closed.
+// Transports may read request bodies even after responses are returned so
+// it can't go back to the pool before that.
+type pooledBuffer struct {
+	pool *bufferPool
+	buf  *bytes.Buffer
+	refs int32
+}
+
+// Len returns the length of the buffer.
+func (b *pooledBuffer) Len() int {
+	return b.buf.Len()
+}
+
+// reader returns a reader of the buffer that holds it until it's closed.
+func (b *pooledBuffer) reader() io.ReadCloser {
+	atomic.AddInt32(&b.refs, 1)
+	return &pooledReader{Reader: bytes.NewReader(b.buf.Bytes()), b: b}
+}
+
+// release drops a reference to the buffer.
+func (b *pooledBuffer) release() {
+	if atomic.AddInt32(&b.refs, -1) == 0 {
+		b.pool.put(b.buf)
+	}
+}
+
+type pooledReader struct {
+	*bytes.Reader
+	b    *pooledBuffer
+	once sync.Once
+}
+
+func (r *pooledReader) Close() error {
+	r.once.Do(r.b.release)
+	return nil
+}
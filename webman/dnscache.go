@@ -0,0 +1,77 @@
+package webman
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsCache caches the resolved ips of upstream hosts for a ttl.
+type dnsCache struct {
+	ttl     time.Duration
+	lookup  func(ctx context.Context, host string) ([]net.IPAddr, error)
+	now     func() time.Time
+	entries map[string]dnsEntry
+	m       sync.Mutex
+}
+
+type dnsEntry struct {
+	addrs     []net.IPAddr
+	expiresAt time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		lookup:  net.DefaultResolver.LookupIPAddr,
+		now:     time.Now,
+		entries: map[string]dnsEntry{},
+	}
+}
+
+// resolve returns the cached ips of host or looks them up when they're missing or expired.
+func (c *dnsCache) resolve(ctx context.Context, host string) ([]net.IPAddr, error) {
+	c.m.Lock()
+	entry, ok := c.entries[host]
+	c.m.Unlock()
+	now := c.now()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.m.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expiresAt: now.Add(c.ttl)}
+	c.m.Unlock()
+	return addrs, nil
+}
+
+// dialContext wraps dial to connect to the cached ips of hosts one by one until
+// one of them succeeds.
+func (c *dnsCache) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := c.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range addrs {
+			var conn net.Conn
+			conn, err = dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		if err == nil {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,99 @@
+package webman
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// defaultContentDecoders decodes response bodies by their Content-Encoding.
+// br isn't supported by the standard library so it's only accepted when a decoder
+// is added with ContentDecoderOption.
+var defaultContentDecoders = map[string]func(io.Reader) (io.Reader, error){
+	"gzip": func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": decodeDeflate,
+}
+
+// decodeDeflate decodes zlib wrapped deflate data as specified by HTTP and
+// falls back to raw deflate data that is sent by some servers.
+func decodeDeflate(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// zlib header's first byte is the compression method and the header is multiple of 31.
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// acceptEncoding returns the value of Accept-Encoding header for the supported encodings.
+func (w *Webman) acceptEncoding() string {
+	var encodings []string
+	for encoding := range w.contentDecoders {
+		encodings = append(encodings, encoding)
+	}
+	sort.Strings(encodings)
+	return strings.Join(encodings, ", ")
+}
+
+// decodeContent replaces the body of resp with its decoded version by Content-Encoding.
+// Responses without a body are left as is.
+func (w *Webman) decodeContent(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || !hasBody(resp) {
+		return nil
+	}
+	decode, ok := w.contentDecoders[encoding]
+	if !ok {
+		return fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	// peek to find out empty bodies of responses with unknown length.
+	body := bufio.NewReader(resp.Body)
+	if _, err := body.Peek(1); err == io.EOF {
+		return nil
+	}
+	r, err := decode(body)
+	if err != nil {
+		return fmt.Errorf("err while decoding %s response: %s", encoding, err)
+	}
+	resp.Body = &decodedBody{Reader: r, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// hasBody reports whether resp can have a body.
+func hasBody(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified ||
+		resp.ContentLength == 0 {
+		return false
+	}
+	return resp.Request == nil || resp.Request.Method != http.MethodHead
+}
+
+// decodedBody reads a decoded body and closes the original body.
+type decodedBody struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (b *decodedBody) Close() error {
+	if c, ok := b.Reader.(io.Closer); ok {
+		c.Close()
+	}
+	return b.body.Close()
+}
@@ -0,0 +1,88 @@
+package webman
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// etagCache keeps the last responses with ETags of requests up to a max number of entries.
+// Requests are keyed by their urls and headers so responses of requests with different
+// credentials aren't served to each other.
+type etagCache struct {
+	maxEntries int
+
+	ll    *list.List
+	items map[string]*list.Element
+	m     sync.Mutex
+}
+
+type etagEntry struct {
+	key      string
+	etag     string
+	response Response
+}
+
+func newETagCache(maxEntries int) *etagCache {
+	return &etagCache{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+// get returns the cached entry of key if any.
+func (c *etagCache) get(key string) *etagEntry {
+	c.m.Lock()
+	defer c.m.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*etagEntry)
+}
+
+// set caches the response of key with its etag and evicts the least recently used
+// entry when the cache is full.
+func (c *etagCache) set(key, etag string, resp Response) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	entry := &etagEntry{key: key, etag: etag, response: resp}
+	if e, ok := c.items[key]; ok {
+		e.Value = entry
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.ll.PushFront(entry)
+	if c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*etagEntry).key)
+	}
+}
+
+// cacheable reports whether responses of r can be cached with their ETags.
+func cacheable(r *Request) bool {
+	return r.Method == http.MethodGet
+}
+
+// etagKey creates the cache key of r from its url and headers.
+func etagKey(r *Request) string {
+	keys := make([]string, 0, len(r.Header))
+	for key := range r.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(r.URL)
+	for _, key := range keys {
+		b.WriteString("\n")
+		b.WriteString(http.CanonicalHeaderKey(key))
+		b.WriteString(": ")
+		b.WriteString(strings.Join(r.Header[key], ", "))
+	}
+	return b.String()
+}
@@ -0,0 +1,90 @@
+package webman
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// statusRecorder records the status code written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// logAccess logs method, path, status, duration and remote address of each request.
+func (w *Webman) logAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		w.log.Printf("%s %s %d %s %s", r.Method, r.URL.Path, rec.status, time.Since(start), r.RemoteAddr)
+	})
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx that carries the request id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id carried by ctx if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// stampRequestID reads the request id from the request id header or generates a new one,
+// puts it into request's context and echoes it back in the response header.
+func (w *Webman) stampRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(w.requestIDHeader)
+		if id == "" {
+			id = uuid.NewV4().String()
+		}
+		rw.Header().Set(w.requestIDHeader, id)
+		next.ServeHTTP(rw, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// decodeRequestBody replaces gzip encoded request bodies with their decoded version
+// so handlers can read them as is.
+func (wh *Webhook) decodeRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if encoding != "gzip" {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		body := bufio.NewReader(r.Body)
+		if _, err := body.Peek(1); err != io.EOF {
+			gr, err := gzip.NewReader(body)
+			if err != nil {
+				wh.writeError(rw, &StatusError{
+					Code: http.StatusBadRequest,
+					Err:  errors.New("invalid gzip body"),
+				})
+				return
+			}
+			r.Body = &decodedBody{Reader: gr, body: r.Body}
+		}
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		next.ServeHTTP(rw, r)
+	})
+}
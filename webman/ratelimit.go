@@ -0,0 +1,45 @@
+package webman
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket rate limiter.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	tokens float64
+	last   time.Time
+	m      sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// take takes a token from the bucket if there is one.
+// Otherwise it returns the duration to wait for the next token.
+func (b *tokenBucket) take() (ok bool, wait time.Duration) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
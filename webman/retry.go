@@ -0,0 +1,87 @@
+package webman
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// defaultMaxRetryDelay caps the Retry-After delays of responses when a max isn't set.
+const defaultMaxRetryDelay = 30 * time.Second
+
+// shouldRetry reports whether a request with method, resp and err is worth to retry.
+// Requests with non idempotent methods are only retried on connection errors when
+// they couldn't reach the upstream, so they're never sent twice.
+func shouldRetry(ctx context.Context, method string, resp *http.Response, err error) bool {
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		return isIdempotent(method) || isDialError(err)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// isIdempotent reports whether requests with method can be safely sent more than once.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isDialError reports whether err is caused by failing to connect.
+func isDialError(err error) bool {
+	if transportErr, ok := err.(*TransportError); ok {
+		err = transportErr.Err
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// retryAfter parses the Retry-After header of resp given in seconds or as http date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := date.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// exceedsDeadline reports whether waiting for d passes the deadline of ctx.
+func exceedsDeadline(ctx context.Context, d time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < d
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,70 @@
+package webman
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultDialTimeout = 30 * time.Second
+	defaultKeepAlive   = 30 * time.Second
+)
+
+// newTransport creates a http transport with the default settings of http.DefaultTransport
+// and the configured dialer, dns cache and client certificate. tlsConfig is used for https connections when it's set.
+func (w *Webman) newTransport(tlsConfig *tls.Config) *http.Transport {
+	if w.clientCert != nil {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.Certificates = []tls.Certificate{*w.clientCert}
+	}
+	dial := w.newDialer().DialContext
+	if w.dnsCache != nil {
+		dial = w.dnsCache.dialContext(dial)
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		MaxConnsPerHost:       w.maxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     w.http2,
+	}
+}
+
+// newDialer creates the dialer of upstream connections.
+func (w *Webman) newDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   w.dialTimeout,
+		KeepAlive: w.keepAlive,
+		Control:   w.dialControl,
+	}
+}
+
+// loadClientCert loads the client certificate from its files or pem blocks when they're set.
+func (w *Webman) loadClientCert() error {
+	var (
+		cert tls.Certificate
+		err  error
+	)
+	switch {
+	case w.clientCertFile != "" || w.clientKeyFile != "":
+		cert, err = tls.LoadX509KeyPair(w.clientCertFile, w.clientKeyFile)
+	case w.clientCertPEM != nil || w.clientKeyPEM != nil:
+		cert, err = tls.X509KeyPair(w.clientCertPEM, w.clientKeyPEM)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid client certificate: %s", err)
+	}
+	w.clientCert = &cert
+	return nil
+}
@@ -0,0 +1,54 @@
+package webman
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listenFull creates a listener that never accepts and fills its accept queue so
+// the next connections to it can't be established.
+func listenFull(t *testing.T) (addr string, closeFn func()) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}))
+	assert.Nil(t, syscall.Listen(fd, 0))
+	sa, err := syscall.Getsockname(fd)
+	assert.Nil(t, err)
+	addr = fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+
+	var conns []net.Conn
+	for i := 0; i < 8; i++ {
+		conn, err := net.DialTimeout("tcp", addr, time.Millisecond*200)
+		if err != nil {
+			break
+		}
+		conns = append(conns, conn)
+	}
+	return addr, func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		syscall.Close(fd)
+	}
+}
+
+func TestDialTimeoutBacklogFull(t *testing.T) {
+	addr, closeFn := listenFull(t)
+	defer closeFn()
+
+	w, err := New(LoggerOption(logger), TimeoutOption(time.Second*10), DialTimeoutOption(time.Millisecond*100))
+	assert.Nil(t, err)
+
+	start := time.Now()
+	_, err = w.Do(context.Background(), &Request{URL: "http://" + addr})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "i/o timeout")
+	assert.True(t, isDialError(err))
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -3,25 +3,173 @@ package webman
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/tylerb/graceful"
 )
 
+// ErrAddrInUse is returned from StartWebhook when the listen address is already in use.
+var ErrAddrInUse = errors.New("webhook listen address is already in use")
+
+// TransportError is returned from requests that fail to be sent or
+// to receive their responses.
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return e.Err.Error()
+}
+
+// DecodeError is returned from requests whose response bodies can't be decoded.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+// ResponseTooLargeError is returned from requests whose response bodies exceed
+// their size limits.
+type ResponseTooLargeError struct {
+	Limit int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response body exceeds the limit of %d bytes", e.Limit)
+}
+
 // Webman holds information about a webman app.
 type Webman struct {
 	timeout time.Duration
 	client  *http.Client
 
+	// contentDecoders decodes response bodies by their Content-Encoding.
+	contentDecoders map[string]func(io.Reader) (io.Reader, error)
+
+	// etags caches responses of GET requests by their ETags when set.
+	etags *etagCache
+
+	// buffers reuses the buffers of request bodies when set.
+	buffers *bufferPool
+
+	// defaultHeaders are set to all requests before their own headers.
+	defaultHeaders map[string]string
+
+	// dialTimeout limits the time to connect to upstreams separately from timeout.
+	dialTimeout time.Duration
+
+	// dialControl checks the resolved addresses of upstream connections before they're made.
+	dialControl func(network, address string, c syscall.RawConn) error
+
+	// checkRedirect checks the redirects of requests before they're followed.
+	checkRedirect func(req *http.Request, via []*http.Request) error
+
+	// maxResponseBytes limits the size of response bodies read by Do, zero means no limit.
+	maxResponseBytes int64
+
+	// clientCert is the client certificate of mutual tls, it's loaded from
+	// the files or the pem blocks.
+	clientCertFile, clientKeyFile string
+	clientCertPEM, clientKeyPEM   []byte
+	clientCert                    *tls.Certificate
+
+	// debugBodyLog logs the request and response bodies with the values of
+	// debugRedactKeys masked.
+	debugBodyLog    bool
+	debugRedactKeys []string
+
+	// keepAlive is the keep-alive period of upstream connections.
+	keepAlive time.Duration
+
+	// maxConnsPerHost limits the connections to each upstream host, zero means no limit.
+	maxConnsPerHost int
+
+	// dnsCacheTTL is the duration that resolved ips of upstream hosts are cached,
+	// zero means they're not cached.
+	dnsCacheTTL time.Duration
+	dnsCache    *dnsCache
+
+	// insecureClient skips tls verification for requests that ask for it.
+	insecureClient *http.Client
+
+	// gracefulTimeout is the duration to wait for in-flight webhook requests while shutting down.
+	gracefulTimeout time.Duration
+
 	webhook *Webhook
 	mw      sync.RWMutex
 
+	// webhookStopped is set by ShutdownWebhook to keep a later StartWebhook from serving.
+	webhookStopped bool
+
+	// activeConns is the number of open webhook connections.
+	activeConns int64
+
+	// readyC closed when webhook server starts listening.
+	readyC chan struct{}
+
+	// timeouts of webhook server.
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+
+	// maxHeaderBytes limits the size of webhook request headers.
+	maxHeaderBytes int
+
+	// webhookCert is the certificate of the webhook server loaded from its files
+	// to serve tls when they're set.
+	webhookCertFile, webhookKeyFile string
+	webhookCert                     *tls.Certificate
+
+	// http2 enables HTTP/2 for upstream requests and the tls webhook server.
+	http2 bool
+
+	accessLog       bool
+	requestIDHeader string
+
+	// pathPrefixes are the additional path prefixes that webhook accepts requests from.
+	pathPrefixes []string
+
+	// webhookMethods are the http methods that webhook accepts, it's POST when not set.
+	webhookMethods []string
+
+	// middlewares wraps the webhook router.
+	middlewares []func(http.Handler) http.Handler
+
+	// rate limit of webhook requests per second.
+	rateLimit      float64
+	rateLimitBurst int
+
+	// retryAttempts is the max number of attempts of requests that fail with
+	// a connection error, 429 or 503 with a doubling retryDelay between each.
+	// Retry-After header of responses is used instead of the delay when it's set,
+	// capped by maxRetryDelay.
+	retryAttempts int
+	retryDelay    time.Duration
+	maxRetryDelay time.Duration
+
+	// retryBudget limits the retries of all requests when set.
+	retryBudget *tokenBucket
+
 	log *log.Logger
 }
 
@@ -31,7 +179,16 @@ type Option func(*Webman)
 // New creates a new Webman with given options.
 func New(options ...Option) (*Webman, error) {
 	w := &Webman{
-		timeout: time.Second * 10,
+		timeout:     time.Second * 10,
+		dialTimeout: defaultDialTimeout,
+		keepAlive:   defaultKeepAlive,
+		http2:       true,
+		readyC:      make(chan struct{}),
+
+		contentDecoders: map[string]func(io.Reader) (io.Reader, error){},
+	}
+	for encoding, decode := range defaultContentDecoders {
+		w.contentDecoders[encoding] = decode
 	}
 	for _, option := range options {
 		option(w)
@@ -39,19 +196,308 @@ func New(options ...Option) (*Webman, error) {
 	if w.log == nil {
 		return nil, errors.New("no logger set")
 	}
-	w.client = &http.Client{
-		Timeout: w.timeout,
+	if w.rateLimit > 0 && w.rateLimitBurst < 1 {
+		return nil, errors.New("rate limit burst must be at least 1")
+	}
+	if w.gracefulTimeout == 0 {
+		w.gracefulTimeout = w.timeout
+	}
+	if w.maxRetryDelay <= 0 {
+		w.maxRetryDelay = defaultMaxRetryDelay
+	}
+	if w.dnsCacheTTL > 0 {
+		w.dnsCache = newDNSCache(w.dnsCacheTTL)
+	}
+	if err := w.loadClientCert(); err != nil {
+		return nil, err
+	}
+	if w.webhookCertFile != "" || w.webhookKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(w.webhookCertFile, w.webhookKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook certificate: %s", err)
+		}
+		w.webhookCert = &cert
+	}
+	if w.client == nil {
+		w.client = &http.Client{Transport: w.newTransport(nil)}
+	} else {
+		client := *w.client
+		w.client = &client
+	}
+	w.insecureClient = &http.Client{
+		Transport: w.newTransport(&tls.Config{InsecureSkipVerify: true}),
+	}
+	if w.checkRedirect != nil {
+		w.client.CheckRedirect = w.redirectPolicy(w.client.CheckRedirect)
+		w.insecureClient.CheckRedirect = w.redirectPolicy(nil)
 	}
 	return w, nil
 }
 
 // TimeoutOption specifies a timeout for unresponsive http calls.
+// It's applied to the requests whose contexts don't have deadlines so
+// callers can set shorter or longer ones.
 func TimeoutOption(d time.Duration) Option {
 	return func(w *Webman) {
 		w.timeout = d
 	}
 }
 
+// DialTimeoutOption limits the time to establish connections to upstreams.
+// It's independent from the overall request timeout and not applied to clients set by ClientOption.
+func DialTimeoutOption(d time.Duration) Option {
+	return func(w *Webman) {
+		w.dialTimeout = d
+	}
+}
+
+// DialControlOption calls control with the resolved address of each upstream connection
+// before it's made so connections can be rejected by their ips. It's not applied to
+// clients set by ClientOption.
+func DialControlOption(control func(network, address string, c syscall.RawConn) error) Option {
+	return func(w *Webman) {
+		w.dialControl = control
+	}
+}
+
+// CheckRedirectOption calls check for each redirect of requests before it's followed
+// and fails the requests with its error. The redirect policy of the client is applied after it.
+func CheckRedirectOption(check func(req *http.Request, via []*http.Request) error) Option {
+	return func(w *Webman) {
+		w.checkRedirect = check
+	}
+}
+
+// ClientCertOption sends the certificate in certFile with the private key in keyFile
+// to upstreams that require client certificates for mutual tls.
+// It's not applied to clients set by ClientOption.
+func ClientCertOption(certFile, keyFile string) Option {
+	return func(w *Webman) {
+		w.clientCertFile = certFile
+		w.clientKeyFile = keyFile
+	}
+}
+
+// ClientCertPEMOption is like ClientCertOption but with pem encoded certificate and key.
+func ClientCertPEMOption(certPEM, keyPEM []byte) Option {
+	return func(w *Webman) {
+		w.clientCertPEM = certPEM
+		w.clientKeyPEM = keyPEM
+	}
+}
+
+// MaxResponseBytesOption limits the size of response bodies read by Do to n bytes.
+// Requests with larger responses fail with *ResponseTooLargeError.
+func MaxResponseBytesOption(n int64) Option {
+	return func(w *Webman) {
+		w.maxResponseBytes = n
+	}
+}
+
+// DebugBodyLogOption sets whether the bodies of requests and the response bodies read by
+// Do and PostRaw are logged for debugging. Values of json keys in redactKeys are masked
+// at any depth and bodies that aren't json are not logged when there are redact keys.
+// It's disabled by default.
+func DebugBodyLogOption(enabled bool, redactKeys []string) Option {
+	return func(w *Webman) {
+		w.debugBodyLog = enabled
+		w.debugRedactKeys = redactKeys
+	}
+}
+
+// KeepAliveOption sets the period of tcp keep-alive probes of upstream connections
+// to detect dead peers. Negative d disables keep-alives. It's 30s by default and
+// not applied to clients set by ClientOption.
+func KeepAliveOption(d time.Duration) Option {
+	return func(w *Webman) {
+		w.keepAlive = d
+	}
+}
+
+// MaxConnsPerHostOption limits the connections to each upstream host to n.
+// Requests wait for a free connection within their timeout instead of opening new ones.
+// It's not applied to clients set by ClientOption.
+func MaxConnsPerHostOption(n int) Option {
+	return func(w *Webman) {
+		w.maxConnsPerHost = n
+	}
+}
+
+// DNSCacheOption caches the resolved ips of upstream hosts for ttl to not look them up
+// for each new connection. It's not applied to clients set by ClientOption.
+func DNSCacheOption(ttl time.Duration) Option {
+	return func(w *Webman) {
+		w.dnsCacheTTL = ttl
+	}
+}
+
+// ContentDecoderOption adds a decoder for responses with the Content-Encoding encoding.
+// gzip and deflate encodings are supported by default, others like br can be added with it
+// by using a maintained decoder such as github.com/andybalholm/brotli.
+func ContentDecoderOption(encoding string, decode func(io.Reader) (io.Reader, error)) Option {
+	return func(w *Webman) {
+		w.contentDecoders[strings.ToLower(encoding)] = decode
+	}
+}
+
+// DefaultHeadersOption sets headers to all requests.
+// Headers of requests override them.
+func DefaultHeadersOption(headers map[string]string) Option {
+	return func(w *Webman) {
+		w.defaultHeaders = map[string]string{}
+		for key, value := range headers {
+			w.defaultHeaders[key] = value
+		}
+	}
+}
+
+// BufferPoolOption sets whether request bodies are marshaled into buffers that are
+// reused across requests to reduce allocations under high throughput.
+func BufferPoolOption(enabled bool) Option {
+	return func(w *Webman) {
+		w.buffers = nil
+		if enabled {
+			w.buffers = newBufferPool()
+		}
+	}
+}
+
+// ETagCacheOption caches the responses of GET requests that have an ETag
+// up to maxEntries urls and headers. Cached responses are revalidated with If-None-Match
+// and returned when upstream replies with 304.
+func ETagCacheOption(maxEntries int) Option {
+	return func(w *Webman) {
+		w.etags = nil
+		if maxEntries > 0 {
+			w.etags = newETagCache(maxEntries)
+		}
+	}
+}
+
+// ClientOption sets the http client used for requests to configure
+// its transport, redirect policy or cookie jar.
+// Timeout is still applied to the requests without deadlines.
+func ClientOption(client *http.Client) Option {
+	return func(w *Webman) {
+		w.client = client
+	}
+}
+
+// RetryOption retries requests up to attempts times when they fail with a connection error,
+// 429 or 503 responses. Requests with non idempotent methods like POST are retried on
+// connection errors only when they fail to connect. The delay between attempts doubles each
+// time unless the response has a Retry-After header, which is used instead by capping it to
+// maxDelay or to 30s when it's zero. Requests aren't retried when the delay passes their deadlines.
+func RetryOption(attempts int, delay, maxDelay time.Duration) Option {
+	return func(w *Webman) {
+		w.retryAttempts = attempts
+		w.retryDelay = delay
+		w.maxRetryDelay = maxDelay
+	}
+}
+
+// RetryBudgetOption limits the retries of all requests to maxRetriesPerSecond so
+// requests that fail together, like the ones of a batch to a degraded upstream,
+// don't multiply the load. Requests fail without retrying when the budget is exhausted.
+func RetryBudgetOption(maxRetriesPerSecond float64) Option {
+	return func(w *Webman) {
+		w.retryBudget = newTokenBucket(maxRetriesPerSecond, int(math.Max(1, math.Ceil(maxRetriesPerSecond))))
+	}
+}
+
+// GracefulTimeoutOption specifies the duration to wait for in-flight webhook requests
+// while shutting down the webhook server. It defaults to timeout.
+func GracefulTimeoutOption(d time.Duration) Option {
+	return func(w *Webman) {
+		w.gracefulTimeout = d
+	}
+}
+
+// WebhookServerTimeoutsOption sets read, write and idle timeouts of the webhook server.
+// Zero means no timeout.
+func WebhookServerTimeoutsOption(read, write, idle time.Duration) Option {
+	return func(w *Webman) {
+		w.readTimeout = read
+		w.writeTimeout = write
+		w.idleTimeout = idle
+	}
+}
+
+// WebhookTLSOption serves the webhook server with tls by using the certificate in certFile
+// and the private key in keyFile.
+func WebhookTLSOption(certFile, keyFile string) Option {
+	return func(w *Webman) {
+		w.webhookCertFile = certFile
+		w.webhookKeyFile = keyFile
+	}
+}
+
+// HTTP2Option sets whether HTTP/2 is negotiated with upstreams over tls and advertised
+// by the tls webhook server. It's enabled by default and not applied to clients set by ClientOption.
+func HTTP2Option(enabled bool) Option {
+	return func(w *Webman) {
+		w.http2 = enabled
+	}
+}
+
+// WebhookMaxHeaderBytesOption limits the size of webhook request headers to n bytes,
+// requests with larger headers are rejected with 431. Zero means the default limit of net/http.
+func WebhookMaxHeaderBytesOption(n int) Option {
+	return func(w *Webman) {
+		w.maxHeaderBytes = n
+	}
+}
+
+// WebhookAccessLogOption enables logging of each webhook request.
+func WebhookAccessLogOption(enabled bool) Option {
+	return func(w *Webman) {
+		w.accessLog = enabled
+	}
+}
+
+// WebhookRequestIDHeaderOption enables request ids for webhook requests.
+// Id is read from header or generated when missing and it's echoed back in the same header.
+func WebhookRequestIDHeaderOption(header string) Option {
+	return func(w *Webman) {
+		w.requestIDHeader = header
+	}
+}
+
+// WebhookRateLimitOption limits webhook requests to requestsPerSecond with burst.
+// Requests over the limit are replied with 429. burst must be at least 1.
+func WebhookRateLimitOption(requestsPerSecond float64, burst int) Option {
+	return func(w *Webman) {
+		w.rateLimit = requestsPerSecond
+		w.rateLimitBurst = burst
+	}
+}
+
+// WebhookPathPrefixesOption makes webhook accept requests to paths that start with prefixes
+// in addition to its endpoint.
+func WebhookPathPrefixesOption(prefixes ...string) Option {
+	return func(w *Webman) {
+		w.pathPrefixes = append(w.pathPrefixes, prefixes...)
+	}
+}
+
+// WebhookMethodsOption makes webhook accept requests with methods instead of only POST.
+func WebhookMethodsOption(methods ...string) Option {
+	return func(w *Webman) {
+		w.webhookMethods = nil
+		for _, method := range methods {
+			w.webhookMethods = append(w.webhookMethods, strings.ToUpper(method))
+		}
+	}
+}
+
+// WebhookMiddlewareOption wraps webhook handler with mw.
+// The first middleware is the outermost one and they're all run after the built-in middlewares.
+func WebhookMiddlewareOption(mw ...func(http.Handler) http.Handler) Option {
+	return func(w *Webman) {
+		w.middlewares = append(w.middlewares, mw...)
+	}
+}
+
 // LoggerOption used to log webhook logs.
 func LoggerOption(l *log.Logger) Option {
 	return func(w *Webman) {
@@ -61,49 +507,505 @@ func LoggerOption(l *log.Logger) Option {
 
 // Post performs a http post request to given url with json data.
 // out will be filled by response json.
+// Failures of sending the request are returned as *TransportError and
+// failures of decoding the response as *DecodeError.
 func (w *Webman) Post(url string, data, out interface{}) (statusCode int, err error) {
-	dataBytes, err := json.Marshal(data)
+	return w.PostContext(context.Background(), url, data, out)
+}
+
+// PostContext is like Post but the request is canceled when ctx is done.
+func (w *Webman) PostContext(ctx context.Context, url string, data, out interface{}) (statusCode int, err error) {
+	resp, err := w.post(ctx, url, data)
 	if err != nil {
 		return statusCode, err
 	}
-	resp, err := w.client.Post(url, "application/json", bytes.NewBuffer(dataBytes))
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.StatusCode, &DecodeError{err}
+	}
+	return resp.StatusCode, nil
+}
+
+// PostRaw performs a http post request like PostContext but returns the response body as is.
+func (w *Webman) PostRaw(ctx context.Context, url string, data interface{}) (statusCode int, body []byte, err error) {
+	resp, err := w.post(ctx, url, data)
+	if err != nil {
+		return statusCode, nil, err
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, body, &TransportError{err}
+	}
+	if w.debugBodyLog {
+		w.logBody("response body of POST %s with status %d: %s", body, url, resp.StatusCode)
+	}
+	return resp.StatusCode, body, nil
+}
+
+// PostStream performs a http post request like Post for responses that stream
+// json values like newline delimited json. onItem is called for each value in order
+// and reading stops at the first error returned from it.
+func (w *Webman) PostStream(url string, data interface{}, onItem func(json.RawMessage) error) (statusCode int, err error) {
+	resp, err := w.post(context.Background(), url, data)
 	if err != nil {
 		return statusCode, err
 	}
 	defer resp.Body.Close()
-	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var item json.RawMessage
+		if err := dec.Decode(&item); err != nil {
+			if err == io.EOF {
+				return resp.StatusCode, nil
+			}
+			return resp.StatusCode, &DecodeError{err}
+		}
+		if err := onItem(item); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+}
+
+func (w *Webman) post(ctx context.Context, url string, data interface{}) (*http.Response, error) {
+	return w.do(ctx, &Request{URL: url, Body: data})
+}
+
+// Request is a http request made by Do.
+type Request struct {
+	// Method defaults to POST.
+	Method string
+	URL    string
+	Header http.Header
+
+	// Body is sent as json.
+	Body interface{}
+
+	// InsecureSkipVerify disables tls certificate verification for this request.
+	InsecureSkipVerify bool
+
+	// MaxResponseBytes overrides the size limit of the response body when it's set.
+	MaxResponseBytes int64
+}
+
+// Response is the response of a request made by Do.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// Status is the status line like "200 OK" and Proto is the protocol like "HTTP/1.1".
+	Status string
+	Proto  string
+}
+
+// Do performs the http request r and returns its response with the body read.
+// Headers of r are set after the default ones and the ones of DefaultHeadersOption
+// so they can override them.
+func (w *Webman) Do(ctx context.Context, r *Request) (*Response, error) {
+	var (
+		cached   *etagEntry
+		cacheKey string
+	)
+	if w.etags != nil && cacheable(r) {
+		cacheKey = etagKey(r)
+		if cached = w.etags.get(cacheKey); cached != nil {
+			revalidate := *r
+			revalidate.Header = http.Header{}
+			for key, values := range r.Header {
+				revalidate.Header[http.CanonicalHeaderKey(key)] = values
+			}
+			revalidate.Header.Set("If-None-Match", cached.etag)
+			r = &revalidate
+		}
+	}
+
+	resp, err := w.do(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	limit := w.maxResponseBytes
+	if r.MaxResponseBytes > 0 {
+		limit = r.MaxResponseBytes
+	}
+	var bodyReader io.Reader = resp.Body
+	if limit > 0 {
+		// read a byte more than the limit to know whether it's exceeded.
+		bodyReader = io.LimitReader(resp.Body, limit+1)
+	}
+	body, err := ioutil.ReadAll(bodyReader)
+	if err != nil {
+		return &Response{StatusCode: resp.StatusCode, Header: resp.Header}, &TransportError{err}
+	}
+	if limit > 0 && int64(len(body)) > limit {
+		return &Response{StatusCode: resp.StatusCode, Header: resp.Header}, &ResponseTooLargeError{Limit: limit}
+	}
+	if w.debugBodyLog {
+		w.logBody("response body of %s %s with status %d: %s", body, resp.Request.Method, r.URL, resp.StatusCode)
+	}
+
+	if cached != nil && resp.StatusCode == http.StatusNotModified {
+		response := cached.response
+		return &response, nil
+	}
+	response := Response{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       body,
+		Status:     resp.Status,
+		Proto:      resp.Proto,
+	}
+	if etag := resp.Header.Get("ETag"); cacheKey != "" &&
+		etag != "" && resp.StatusCode == http.StatusOK {
+		w.etags.set(cacheKey, etag, response)
+	}
+	return &response, nil
+}
+
+// do sends r with the default timeout when ctx doesn't have a deadline.
+// The timeout covers reading the response body until it's closed.
+func (w *Webman) do(ctx context.Context, r *Request) (*http.Response, error) {
+	if _, ok := ctx.Deadline(); ok || w.timeout <= 0 {
+		return w.send(ctx, r)
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	resp, err := w.send(ctx, r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelReadCloser{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelReadCloser cancels the context of a response when its body is closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (w *Webman) send(ctx context.Context, r *Request) (*http.Response, error) {
+	method := r.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	var (
+		dataBytes []byte
+		buf       *pooledBuffer
+	)
+	// requests other than POST are sent without a body when it's not set.
+	if r.Body != nil || method == http.MethodPost {
+		var err error
+		if w.buffers != nil {
+			if buf, err = w.buffers.marshal(r.Body); err != nil {
+				return nil, err
+			}
+			defer buf.release()
+		} else if dataBytes, err = json.Marshal(r.Body); err != nil {
+			return nil, err
+		}
+	}
+	if w.debugBodyLog {
+		body := dataBytes
+		if buf != nil {
+			body = buf.buf.Bytes()
+		}
+		w.logBody("request body of %s %s: %s", body, method, r.URL)
+	}
+	client := w.client
+	if r.InsecureSkipVerify {
+		client = w.insecureClient
+	}
+
+	delay := w.retryDelay
+	for attempt := 1; ; attempt++ {
+		req, err := w.newRequest(method, r.URL, dataBytes, buf)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Encoding", w.acceptEncoding())
+		for key, value := range w.defaultHeaders {
+			req.Header.Set(key, value)
+		}
+		for key, values := range r.Header {
+			req.Header[http.CanonicalHeaderKey(key)] = values
+		}
+		if r.InsecureSkipVerify && attempt == 1 {
+			w.log.Printf("warning: tls verification is skipped for the request to %s", req.URL.Host)
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		retry := attempt < w.retryAttempts && shouldRetry(ctx, method, resp, err)
+		wait := delay
+		if d, ok := retryAfter(resp, time.Now()); ok {
+			wait = d
+			if wait > w.maxRetryDelay {
+				wait = w.maxRetryDelay
+			}
+		}
+		if retry && exceedsDeadline(ctx, wait) {
+			retry = false
+			w.log.Printf("retry delay of %s exceeds the deadline, request to %s is not retried", wait, req.URL.Host)
+		}
+		if retry && w.retryBudget != nil {
+			if retry, _ = w.retryBudget.take(); !retry {
+				w.log.Printf("retry budget is exhausted, request to %s is not retried", req.URL.Host)
+			}
+		}
+		if !retry {
+			if err != nil {
+				return nil, &TransportError{err}
+			}
+			if err := w.decodeContent(resp); err != nil {
+				resp.Body.Close()
+				return nil, &DecodeError{err}
+			}
+			return resp, nil
+		}
+
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			w.log.Printf("request to %s failed with status %d, retrying in %s", req.URL.Host, resp.StatusCode, wait)
+		} else {
+			w.log.Printf("request to %s failed, retrying in %s: %s", req.URL.Host, wait, err)
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// maxRedirects is the number of redirects followed by clients without a redirect policy.
+const maxRedirects = 10
+
+// redirectPolicy creates a redirect policy that checks redirects with checkRedirect
+// and then with next or with the default policy of http.Client when it's nil.
+func (w *Webman) redirectPolicy(next func(*http.Request, []*http.Request) error) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if err := w.checkRedirect(req, via); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+}
+
+// newRequest creates a request with body or with buf when it's set.
+func (w *Webman) newRequest(method, url string, body []byte, buf *pooledBuffer) (*http.Request, error) {
+	if buf == nil {
+		return http.NewRequest(method, url, bytes.NewReader(body))
+	}
+	reader := buf.reader()
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	req.ContentLength = int64(buf.Len())
+	req.GetBody = func() (io.ReadCloser, error) {
+		return buf.reader(), nil
+	}
+	return req, nil
 }
 
 // Webhook represent a webhook server.
 type Webhook struct {
-	webman *Webman
-	server *graceful.Server
-	fn     func(*http.Request) error
+	webman  *Webman
+	server  *graceful.Server
+	fn      func(*http.Request) error
+	limiter *tokenBucket
+	stopped bool
+
+	// endpoint is the path that fn is executed for.
+	endpoint string
+
+	// router holds the http.Handler that routes requests, it's swapped by UpdateWebhookRoutes.
+	router atomic.Value
+
+	// addr is the resolved listening address.
+	addr string
 }
 
 // StartWebhook starts the webhook server and executes fn for each received call.
 func (w *Webman) StartWebhook(endpoint, listenAddr string, fn func(*http.Request) error) error {
-	w.webhook = &Webhook{
-		webman: w,
-		fn:     fn,
+	webhook := &Webhook{
+		webman:   w,
+		fn:       fn,
+		endpoint: endpoint,
+	}
+	if w.rateLimit > 0 {
+		webhook.limiter = newTokenBucket(w.rateLimit, w.rateLimitBurst)
 	}
+	webhook.router.Store(webhook.newRouter(nil))
 
-	r := mux.NewRouter()
-	r.HandleFunc(endpoint, w.webhook.handler).Methods("POST")
+	var handler http.Handler = http.HandlerFunc(webhook.route)
+	for i := len(w.middlewares) - 1; i >= 0; i-- {
+		handler = w.middlewares[i](handler)
+	}
+	handler = webhook.decodeRequestBody(handler)
+	if w.requestIDHeader != "" {
+		handler = w.stampRequestID(handler)
+	}
+	if w.accessLog {
+		handler = w.logAccess(handler)
+	}
 
 	server := &graceful.Server{
-		Timeout: w.timeout,
+		Timeout:   w.gracefulTimeout,
+		ConnState: w.trackConn,
 		Server: &http.Server{
-			Addr:    listenAddr,
-			Handler: r,
+			Addr:         listenAddr,
+			Handler:      handler,
+			ReadTimeout:  w.readTimeout,
+			WriteTimeout: w.writeTimeout,
+			IdleTimeout:  w.idleTimeout,
+
+			MaxHeaderBytes: w.maxHeaderBytes,
 		},
 	}
+	// create the listener explicitly to know the actual address when port is 0.
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		if isAddrInUse(err) {
+			w.log.Printf("error while listening webhook server: %s", err)
+			return ErrAddrInUse
+		}
+		return err
+	}
+
+	if w.webhookCert != nil {
+		l = tls.NewListener(l, w.webhookTLSConfig())
+	}
+
+	webhook.server = server
+	webhook.addr = l.Addr().String()
 	w.mw.Lock()
-	w.webhook.server = server
+	if w.webhookStopped {
+		w.mw.Unlock()
+		l.Close()
+		return http.ErrServerClosed
+	}
+	w.webhook = webhook
+	select {
+	case <-w.readyC:
+	default:
+		close(w.readyC)
+	}
 	w.mw.Unlock()
 
-	w.log.Printf("webhook server started at: %s:", listenAddr)
-	return w.webhook.server.ListenAndServe()
+	w.log.Printf("webhook server started at: %s", webhook.addr)
+	return server.Serve(l)
+}
+
+// webhookTLSConfig creates the tls config of the webhook server that advertises
+// HTTP/2 when it's enabled.
+func (w *Webman) webhookTLSConfig() *tls.Config {
+	protos := []string{"http/1.1"}
+	if w.http2 {
+		protos = []string{"h2", "http/1.1"}
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*w.webhookCert},
+		NextProtos:   protos,
+	}
+}
+
+// UpdateWebhookRoutes replaces the routes of the running webhook server with routes
+// that maps paths to their handlers. The endpoint and path prefixes of the webhook
+// are always kept. Requests that are already routed are handled by the old routes.
+func (w *Webman) UpdateWebhookRoutes(routes map[string]func(*http.Request) error) error {
+	for path, fn := range routes {
+		if path == "" || fn == nil {
+			return fmt.Errorf("invalid webhook route %q", path)
+		}
+	}
+	w.mw.RLock()
+	defer w.mw.RUnlock()
+	if w.webhook == nil || w.webhook.stopped {
+		return errors.New("webhook server is not running")
+	}
+	w.webhook.router.Store(w.webhook.newRouter(routes))
+	return nil
+}
+
+// newRouter creates the router of webhook's endpoint, path prefixes and routes.
+func (wh *Webhook) newRouter(routes map[string]func(*http.Request) error) http.Handler {
+	methods := wh.webman.webhookMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodPost}
+	}
+	r := mux.NewRouter()
+	r.HandleFunc(wh.endpoint, wh.handler).Methods(methods...)
+	for _, prefix := range wh.webman.pathPrefixes {
+		r.PathPrefix(prefix).HandlerFunc(wh.handler).Methods(methods...)
+	}
+	for path, fn := range routes {
+		fn := fn
+		r.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+			wh.serve(w, req, fn)
+		}).Methods(methods...)
+	}
+	return r
+}
+
+// route routes r with the current router.
+func (wh *Webhook) route(w http.ResponseWriter, r *http.Request) {
+	wh.router.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+// isAddrInUse reports whether err is caused by binding to an address in use.
+func isAddrInUse(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok || opErr.Op != "listen" {
+		return false
+	}
+	if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+		return sysErr.Err == syscall.EADDRINUSE
+	}
+	return false
+}
+
+// StatusError can be returned from webhook handlers to reply with a specific status code.
+// Err is sent as the error message when it's set, otherwise an empty response is replied.
+type StatusError struct {
+	Code int
+	Err  error
+}
+
+func (e *StatusError) Error() string {
+	if e.Err == nil {
+		return http.StatusText(e.Code)
+	}
+	return e.Err.Error()
+}
+
+// ValidationError can be returned from webhook handlers to reply with all the validation
+// failures of a request. Messages are sent as an array along with the error message.
+type ValidationError struct {
+	Message  string
+	Messages []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Messages) == 0 {
+		return e.Message
+	}
+	return e.Message + ": " + strings.Join(e.Messages, "; ")
 }
 
 type errorResponse struct {
@@ -111,43 +1013,109 @@ type errorResponse struct {
 }
 
 type errorResponseMessage struct {
-	Message string `json:"message"`
+	Message  string   `json:"message"`
+	Messages []string `json:"messages,omitempty"`
 }
 
 func (wh *Webhook) handler(w http.ResponseWriter, r *http.Request) {
-	if err := wh.fn(r); err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
+	wh.serve(w, r, wh.fn)
+}
 
-		bytes, err := json.Marshal(errorResponse{errorResponseMessage{err.Error()}})
-		if err != nil {
-			wh.webman.log.Printf("error while encoding error response: %s", err)
+// serve replies r by executing fn.
+func (wh *Webhook) serve(w http.ResponseWriter, r *http.Request, fn func(*http.Request) error) {
+	if wh.limiter != nil {
+		if ok, wait := wh.limiter.take(); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			wh.writeError(w, &StatusError{
+				Code: http.StatusTooManyRequests,
+				Err:  errors.New("rate limit exceeded"),
+			})
 			return
 		}
-		if _, err := w.Write(bytes); err != nil {
-			wh.webman.log.Printf("error while sending http response: %s", err)
-		}
+	}
+
+	if err := fn(r); err != nil {
+		wh.writeError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusAccepted)
 }
 
-// WebhookAddr returns server listening address.
+func (wh *Webhook) writeError(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+	cause := err
+	if se, ok := err.(*StatusError); ok {
+		code = se.Code
+		if se.Err == nil {
+			w.WriteHeader(code)
+			return
+		}
+		cause = se.Err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	message := errorResponseMessage{Message: err.Error()}
+	if ve, ok := cause.(*ValidationError); ok {
+		message.Messages = ve.Messages
+	}
+	bytes, err := json.Marshal(errorResponse{message})
+	if err != nil {
+		wh.webman.log.Printf("error while encoding error response: %s", err)
+		return
+	}
+	if _, err := w.Write(bytes); err != nil {
+		wh.webman.log.Printf("error while sending http response: %s", err)
+	}
+}
+
+// ActiveConnections returns the number of open webhook connections.
+// It can be used to see how many connections are being drained while shutting down.
+func (w *Webman) ActiveConnections() int {
+	return int(atomic.LoadInt64(&w.activeConns))
+}
+
+func (w *Webman) trackConn(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&w.activeConns, 1)
+	case http.StateClosed, http.StateHijacked:
+		atomic.AddInt64(&w.activeConns, -1)
+	}
+}
+
+// Ready returns a channel that closed when the webhook server starts accepting connections.
+func (w *Webman) Ready() <-chan struct{} {
+	return w.readyC
+}
+
+// WebhookAddr returns server listening address as host:port.
+// It's empty until the server starts listening.
 func (w *Webman) WebhookAddr() string {
 	w.mw.RLock()
 	defer w.mw.RUnlock()
-	if w.webhook.server != nil {
-		return w.webhook.server.Addr
+	if w.webhook != nil {
+		return w.webhook.addr
 	}
 	return ""
 }
 
 // ShutdownWebHook closes webhook server.
+// It's safe to call it when the server isn't started or already closed.
+// StartWebhook returns http.ErrServerClosed without serving once it's called.
 func (w *Webman) ShutdownWebhook() {
-	w.mw.RLock()
-	defer w.mw.RUnlock()
-	if w.webhook != nil {
-		w.webhook.server.Stop(w.timeout)
-		<-w.webhook.server.StopChan()
+	w.mw.Lock()
+	w.webhookStopped = true
+	webhook := w.webhook
+	if webhook == nil || webhook.server == nil || webhook.stopped {
+		w.mw.Unlock()
+		return
 	}
+	webhook.stopped = true
+	// don't hold the lock while draining to not block WebhookAddr and health checks.
+	w.mw.Unlock()
+	w.log.Printf("shutting down webhook server, draining %d connections", w.ActiveConnections())
+	webhook.server.Stop(w.gracefulTimeout)
+	<-webhook.server.StopChan()
 }
@@ -2,14 +2,35 @@ package webman
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -23,94 +44,1753 @@ type postRequest struct {
 	Message string
 }
 
+// webhookURL returns the loopback url of endpoint on the webhook server.
+func webhookURL(t *testing.T, w *Webman, endpoint string) string {
+	_, port, err := net.SplitHostPort(w.WebhookAddr())
+	assert.Nil(t, err)
+	return fmt.Sprintf("http://127.0.0.1:%s%s", port, endpoint)
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	headerC := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headerC <- r.Header
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	headers := map[string]string{"X-Api-Key": "key", "x-tenant": "default"}
+	w, err := New(LoggerOption(logger), DefaultHeadersOption(headers))
+	assert.Nil(t, err)
+	// changes to the given map don't affect the option.
+	headers["X-Api-Key"] = "changed"
+
+	_, err = w.Post(server.URL, nil, &struct{}{})
+	assert.Nil(t, err)
+	header := <-headerC
+	assert.Equal(t, "key", header.Get("X-Api-Key"))
+	assert.Equal(t, "default", header.Get("X-Tenant"))
+
+	_, err = w.Do(context.Background(), &Request{
+		URL:    server.URL,
+		Header: http.Header{"x-tenant": {"tenant"}},
+	})
+	assert.Nil(t, err)
+	header = <-headerC
+	assert.Equal(t, "key", header.Get("X-Api-Key"))
+	assert.Equal(t, []string{"tenant"}, header["X-Tenant"])
+}
+
+func TestDoStatusLine(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+
+	resp, err := w.Do(context.Background(), &Request{URL: server.URL})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "201 Created", resp.Status)
+	assert.Equal(t, "HTTP/1.1", resp.Proto)
+}
+
+func TestPostErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	}))
+	defer server.Close()
+
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+
+	var out postRequest
+	statusCode, err := w.Post(server.URL, nil, &out)
+	assert.Equal(t, http.StatusOK, statusCode)
+	decodeErr, ok := err.(*DecodeError)
+	assert.True(t, ok)
+	assert.IsType(t, &json.SyntaxError{}, decodeErr.Err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = w.Post("http://"+addr, nil, &out)
+	_, ok = err.(*TransportError)
+	assert.True(t, ok)
+	assert.Contains(t, err.Error(), "connection refused")
+}
+
+func TestBufferPool(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data postRequest
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&data))
+		assert.Equal(t, int64(len(`{"Message":""}`)+len(data.Message)), r.ContentLength)
+		json.NewEncoder(w).Encode(data)
+	}))
+	defer server.Close()
+
+	w, err := New(LoggerOption(logger), BufferPoolOption(true))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// bodies of different sizes shouldn't leak into each other.
+			data := postRequest{strings.Repeat(strconv.Itoa(i%10), (50-i)*20)}
+			var out postRequest
+			statusCode, err := w.Post(server.URL, data, &out)
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusOK, statusCode)
+			assert.Equal(t, data, out)
+		}(i)
+	}
+	wg.Wait()
+
+	_, err = w.Post(server.URL, func() {}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestBufferPoolRelease(t *testing.T) {
+	pool := newBufferPool()
+	buf, err := pool.marshal(postRequest{"first"})
+	assert.Nil(t, err)
+	assert.Equal(t, len(`{"Message":"first"}`), buf.Len())
+
+	// the buffer is held by its reader after it's released by its owner.
+	reader := buf.reader()
+	buf.release()
+	next, err := pool.marshal(postRequest{"second"})
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"Message":"first"}`, string(data))
+	assert.Nil(t, reader.Close())
+	assert.Nil(t, reader.Close())
+	assert.Equal(t, int32(0), buf.refs)
+	next.release()
+}
+
+func benchmarkPost(b *testing.B, pooled bool) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	w, err := New(LoggerOption(logger), BufferPoolOption(pooled))
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := postRequest{strings.Repeat("data", 1024)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out postRequest
+		if _, err := w.Post(server.URL, data, &out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPost(b *testing.B) {
+	benchmarkPost(b, false)
+}
+
+func BenchmarkPostBufferPool(b *testing.B) {
+	benchmarkPost(b, true)
+}
+
+func BenchmarkMarshalBody(b *testing.B) {
+	data := postRequest{strings.Repeat("data", 1024)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalBodyBufferPool(b *testing.B) {
+	pool := newBufferPool()
+	data := postRequest{strings.Repeat("data", 1024)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf, err := pool.marshal(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		buf.release()
+	}
+}
+
 func TestPost(t *testing.T) {
 	statusCode := 200
 	data := postRequest{"data"}
 	dataBytes, err := json.Marshal(data)
 	assert.Nil(t, err)
 
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(statusCode)
-		w.Write(dataBytes)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statusCode)
+		w.Write(dataBytes)
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+
+	var out postRequest
+	statusCode1, err := w.Post(ts.URL, data, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, statusCode, statusCode1)
+	assert.Equal(t, data.Message, out.Message)
+}
+
+func TestPostRaw(t *testing.T) {
+	body := []byte("<message>hello</message>")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+
+	statusCode, out, err := w.PostRaw(context.Background(), ts.URL, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, body, out)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestClientOption(t *testing.T) {
+	var requested string
+	client := &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			requested = req.URL.String()
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(`{"Message":"transport"}`)),
+			}, nil
+		}),
+	}
+
+	w, err := New(LoggerOption(logger), ClientOption(client), TimeoutOption(time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), w.client.Timeout)
+
+	var out postRequest
+	statusCode, err := w.Post("http://mesg.com", nil, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "transport", out.Message)
+	assert.Equal(t, "http://mesg.com", requested)
+}
+
+func TestRetryAfter(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"Message":"data"}`))
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger), RetryOption(2, time.Millisecond, time.Second*5))
+	assert.Nil(t, err)
+
+	start := time.Now()
+	var out postRequest
+	statusCode, err := w.Post(ts.URL, nil, &out)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "data", out.Message)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.True(t, time.Since(start) >= time.Millisecond*900)
+	assert.True(t, time.Since(start) < time.Second*3)
+}
+
+func TestRetryBudget(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger), RetryOption(3, time.Millisecond, 0), RetryBudgetOption(2))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := w.Do(context.Background(), &Request{Method: "GET", URL: ts.URL})
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		}()
+	}
+	wg.Wait()
+
+	// each request is sent once and retried only with the budget of 2 retries
+	// that's refilled by 2 per second, instead of 20 retries without it.
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&calls), int32(12))
+	assert.LessOrEqual(t, atomic.LoadInt32(&calls), int32(14))
+}
+
+func TestRetryAfterCapped(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger), RetryOption(3, time.Millisecond, time.Millisecond*10))
+	assert.Nil(t, err)
+
+	start := time.Now()
+	resp, err := w.Do(context.Background(), &Request{URL: ts.URL})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestRetryAfterDefaultCap(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger), RetryOption(3, time.Millisecond, 0), TimeoutOption(time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, defaultMaxRetryDelay, w.maxRetryDelay)
+
+	// the capped delay still passes the timeout so the response is returned without waiting.
+	start := time.Now()
+	resp, err := w.Do(context.Background(), &Request{URL: ts.URL})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.True(t, time.Since(start) < time.Millisecond*500)
+}
+
+func TestRetryConnectionErrorMethods(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		// drop the connection after the request is received.
+		conn, _, err := w.(http.Hijacker).Hijack()
+		assert.Nil(t, err)
+		conn.Close()
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger), RetryOption(2, time.Millisecond, 0))
+	assert.Nil(t, err)
+
+	_, err = w.Do(context.Background(), &Request{URL: ts.URL})
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), atomic.SwapInt32(&calls, 0))
+
+	_, err = w.Do(context.Background(), &Request{Method: http.MethodGet, URL: ts.URL})
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestRetryDialErrorPOST(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	w, err := New(LoggerOption(logger), RetryOption(2, time.Millisecond, 0))
+	assert.Nil(t, err)
+
+	_, err = w.Do(context.Background(), &Request{URL: "http://" + addr})
+	assert.NotNil(t, err)
+	assert.True(t, isDialError(err))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		d     time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"3", time.Second * 3, true},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"soon", 0, false},
+	}
+	for _, test := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Retry-After", test.value)
+		d, ok := retryAfter(resp, now)
+		assert.Equal(t, test.d, d, test.value)
+		assert.Equal(t, test.ok, ok, test.value)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		time.Sleep(time.Millisecond * 300)
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	// dial timeout doesn't limit the slow body once connected.
+	w, err := New(LoggerOption(logger), TimeoutOption(time.Second*10), DialTimeoutOption(time.Millisecond*100))
+	assert.Nil(t, err)
+	resp, err := w.Do(context.Background(), &Request{URL: ts.URL})
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", string(resp.Body))
+
+	// the request timeout does.
+	w, err = New(LoggerOption(logger), TimeoutOption(time.Millisecond*100), DialTimeoutOption(time.Second*10))
+	assert.Nil(t, err)
+	start := time.Now()
+	_, err = w.Do(context.Background(), &Request{URL: ts.URL})
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Millisecond*300)
+}
+
+func TestRequestDeadlineOverridesTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 300)
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger), TimeoutOption(time.Millisecond*100))
+	assert.Nil(t, err)
+
+	// a longer deadline of the request is used instead of the default timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	resp, err := w.Do(ctx, &Request{URL: ts.URL})
+	assert.Nil(t, err)
+	assert.Equal(t, "{}", string(resp.Body))
+
+	// the default timeout is used without a deadline.
+	_, err = w.Do(context.Background(), &Request{URL: ts.URL})
+	assert.NotNil(t, err)
+}
+
+func TestCheckRedirect(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/blocked", http.StatusFound)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	errBlocked := errors.New("blocked")
+	w, err := New(LoggerOption(logger), CheckRedirectOption(func(req *http.Request, via []*http.Request) error {
+		if req.URL.Path == "/blocked" {
+			return errBlocked
+		}
+		return nil
+	}))
+	assert.Nil(t, err)
+
+	_, err = w.Do(context.Background(), &Request{Method: "GET", URL: ts.URL + "/redirect"})
+	assert.NotNil(t, err)
+	assert.Equal(t, errBlocked, err.(*TransportError).Err.(*url.Error).Err)
+
+	resp, err := w.Do(context.Background(), &Request{Method: "GET", URL: ts.URL})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestDialControl(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	var addrs []string
+	errRejected := errors.New("rejected")
+	w, err := New(LoggerOption(logger), DialControlOption(func(network, address string, c syscall.RawConn) error {
+		addrs = append(addrs, address)
+		return errRejected
+	}))
+	assert.Nil(t, err)
+
+	_, err = w.Do(context.Background(), &Request{URL: ts.URL})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{ts.Listener.Addr().String()}, addrs)
+}
+
+func TestETagCache(t *testing.T) {
+	var full, notModified int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&full, 1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"Message":"cached"}`))
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger), ETagCacheOption(10))
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		resp, err := w.Do(context.Background(), &Request{Method: "GET", URL: ts.URL})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, `{"Message":"cached"}`, string(resp.Body))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&full))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notModified))
+
+	// POST requests aren't cached.
+	_, err = w.Do(context.Background(), &Request{URL: ts.URL})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&full))
+}
+
+func TestETagCacheHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger), ETagCacheOption(10))
+	assert.Nil(t, err)
+
+	for _, auth := range []string{"Bearer a", "Bearer b", "Bearer a"} {
+		resp, err := w.Do(context.Background(), &Request{
+			Method: "GET",
+			URL:    ts.URL,
+			Header: http.Header{"Authorization": []string{auth}},
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, auth, string(resp.Body))
+	}
+}
+
+func TestETagCacheEviction(t *testing.T) {
+	c := newETagCache(2)
+	c.set("1", "a", Response{})
+	c.set("2", "b", Response{})
+	c.get("1")
+	c.set("3", "c", Response{})
+	assert.NotNil(t, c.get("1"))
+	assert.Nil(t, c.get("2"))
+	assert.NotNil(t, c.get("3"))
+}
+
+func TestContentEncoding(t *testing.T) {
+	data := []byte(`{"Message":"decoded"}`)
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"gzip":    func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+		"raw-deflate": func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.TrimPrefix(r.URL.Path, "/")
+		if encoding == "reverse" {
+			w.Header().Set("Content-Encoding", "reverse")
+			for i := len(data) - 1; i >= 0; i-- {
+				w.Write(data[i : i+1])
+			}
+			return
+		}
+		var buf bytes.Buffer
+		enc := encoders[encoding](&buf)
+		enc.Write(data)
+		enc.Close()
+		w.Header().Set("Content-Encoding", strings.TrimPrefix(encoding, "raw-"))
+		w.Write(buf.Bytes())
+	}))
+	defer ts.Close()
+
+	reverse := func(r io.Reader) (io.Reader, error) {
+		b, err := ioutil.ReadAll(r)
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return bytes.NewReader(b), err
+	}
+	w, err := New(LoggerOption(logger), ContentDecoderOption("reverse", reverse))
+	assert.Nil(t, err)
+
+	for _, encoding := range []string{"gzip", "deflate", "raw-deflate", "reverse"} {
+		var out postRequest
+		_, err := w.Post(ts.URL+"/"+encoding, nil, &out)
+		assert.Nil(t, err, encoding)
+		assert.Equal(t, "decoded", out.Message, encoding)
+	}
+
+	w, err = New(LoggerOption(logger))
+	assert.Nil(t, err)
+	_, err = w.Do(context.Background(), &Request{URL: ts.URL + "/reverse"})
+	assert.NotNil(t, err)
+	assert.Equal(t, "deflate, gzip", w.acceptEncoding())
+}
+
+func TestContentEncodingWithoutBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		switch r.URL.Path {
+		case "/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/empty":
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"POST", "/no-content", http.StatusNoContent},
+		{"POST", "/empty", http.StatusOK},
+		{"HEAD", "/", http.StatusOK},
+	}
+	for _, test := range tests {
+		resp, err := w.Do(context.Background(), &Request{Method: test.method, URL: ts.URL + test.path})
+		assert.Nil(t, err, test.path)
+		assert.Equal(t, test.status, resp.StatusCode, test.path)
+		assert.Empty(t, resp.Body, test.path)
+	}
+}
+
+func TestETagCacheCompressed(t *testing.T) {
+	data := []byte(`{"Message":"cached"}`)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		gw := gzip.NewWriter(w)
+		gw.Write(data)
+		gw.Close()
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger), ETagCacheOption(10))
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		resp, err := w.Do(context.Background(), &Request{Method: "GET", URL: ts.URL})
+		assert.Nil(t, err)
+		assert.Equal(t, string(data), string(resp.Body))
+	}
+}
+
+func TestPostStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for i := 1; i <= 3; i++ {
+			fmt.Fprintf(w, "{\"message\":\"%d\"}\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+
+	var items []string
+	statusCode, err := w.PostStream(ts.URL, nil, func(item json.RawMessage) error {
+		var out postRequest
+		if err := json.Unmarshal(item, &out); err != nil {
+			return err
+		}
+		items = append(items, out.Message)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, []string{"1", "2", "3"}, items)
+
+	errStop := errors.New("stop")
+	calls := 0
+	_, err = w.PostStream(ts.URL, nil, func(item json.RawMessage) error {
+		calls++
+		return errStop
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestDo(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "PUT", r.Method)
+		assert.Equal(t, "application/vnd.api+json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "1", r.Header.Get("X-Tenant"))
+		w.Header().Set("X-Request-ID", "2")
+		w.WriteHeader(http.StatusCreated)
+		io.Copy(w, r.Body)
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+
+	resp, err := w.Do(context.Background(), &Request{
+		Method: "PUT",
+		URL:    ts.URL,
+		Header: http.Header{
+			"Content-Type": {"application/vnd.api+json"},
+			"X-Tenant":     {"1"},
+		},
+		Body: postRequest{"data"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("X-Request-ID"))
+	assert.Equal(t, `{"Message":"data"}`, string(resp.Body))
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data":"0123456789"}`))
+	}))
+	defer ts.Close()
+
+	w, err := New(LoggerOption(logger), MaxResponseBytesOption(10))
+	assert.Nil(t, err)
+
+	resp, err := w.Do(context.Background(), &Request{URL: ts.URL})
+	assert.Equal(t, &ResponseTooLargeError{Limit: 10}, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, resp.Body)
+
+	// per request limit overrides the global one.
+	resp, err = w.Do(context.Background(), &Request{URL: ts.URL, MaxResponseBytes: 21})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"data":"0123456789"}`, string(resp.Body))
+}
+
+func TestClientCert(t *testing.T) {
+	certPEM, keyPEM, cert := newTestCert(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	ts.StartTLS()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "webman")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.Nil(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+
+	for _, option := range []Option{
+		ClientCertOption(certFile, keyFile),
+		ClientCertPEMOption(certPEM, keyPEM),
+	} {
+		w, err := New(LoggerOption(logger), option)
+		assert.Nil(t, err)
+		resp, err := w.Do(context.Background(), &Request{Method: "GET", URL: ts.URL, InsecureSkipVerify: true})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "webman", string(resp.Body))
+	}
+
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+	_, err = w.Do(context.Background(), &Request{Method: "GET", URL: ts.URL, InsecureSkipVerify: true})
+	assert.NotNil(t, err)
+
+	_, err = New(LoggerOption(logger), ClientCertPEMOption(certPEM, []byte("invalid")))
+	assert.NotNil(t, err)
+}
+
+// newTestCert creates a self-signed certificate for clients and servers of 127.0.0.1.
+func newTestCert(t *testing.T) (certPEM, keyPEM []byte, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "webman"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err = x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, cert
+}
+
+func TestDebugBodyLog(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"user":{"name":"a","token":"response-secret"}}`))
+	}))
+	defer ts.Close()
+
+	body := map[string]interface{}{"password": "request-secret", "items": []interface{}{
+		map[string]interface{}{"Token": "item-secret", "id": 1},
+	}}
+
+	var buf bytes.Buffer
+	w, err := New(LoggerOption(log.New(&buf, "", 0)), DebugBodyLogOption(true, []string{"password", "token"}))
+	assert.Nil(t, err)
+	_, err = w.Do(context.Background(), &Request{URL: ts.URL, Body: body})
+	assert.Nil(t, err)
+	logs := buf.String()
+	assert.Contains(t, logs, `request body of POST `+ts.URL+`: {"items":[{"Token":"[REDACTED]","id":1}],"password":"[REDACTED]"}`)
+	assert.Contains(t, logs, `response body of POST `+ts.URL+` with status 200: {"user":{"name":"a","token":"[REDACTED]"}}`)
+	assert.NotContains(t, logs, "secret")
+
+	buf.Reset()
+	w, err = New(LoggerOption(log.New(&buf, "", 0)), DebugBodyLogOption(true, nil))
+	assert.Nil(t, err)
+	_, _, err = w.PostRaw(context.Background(), ts.URL, body)
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "request-secret")
+	assert.Contains(t, buf.String(), "response-secret")
+
+	buf.Reset()
+	w, err = New(LoggerOption(log.New(&buf, "", 0)))
+	assert.Nil(t, err)
+	_, err = w.Do(context.Background(), &Request{URL: ts.URL, Body: body})
+	assert.Nil(t, err)
+	assert.Empty(t, buf.String())
+}
+
+func TestHTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	// HTTP/2 is negotiated by default like with http.DefaultTransport.
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+	resp, err := w.Do(context.Background(), &Request{Method: "GET", URL: ts.URL, InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+
+	w, err = New(LoggerOption(logger), HTTP2Option(false))
+	assert.Nil(t, err)
+	resp, err = w.Do(context.Background(), &Request{Method: "GET", URL: ts.URL, InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "HTTP/1.1", resp.Proto)
+}
+
+func TestWebhookTLSHTTP2(t *testing.T) {
+	certPEM, keyPEM, cert := newTestCert(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	dir, err := ioutil.TempDir("", "webman")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.Nil(t, ioutil.WriteFile(certFile, certPEM, 0600))
+	assert.Nil(t, ioutil.WriteFile(keyFile, keyPEM, 0600))
+
+	for enabled, proto := range map[bool]string{true: "HTTP/2.0", false: "HTTP/1.1"} {
+		w, err := New(LoggerOption(logger), WebhookTLSOption(certFile, keyFile), HTTP2Option(enabled))
+		assert.Nil(t, err)
+
+		protoC := make(chan string, 1)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			w.StartWebhook("/endpoint", "127.0.0.1:0", func(req *http.Request) error {
+				protoC <- req.Proto
+				return nil
+			})
+			wg.Done()
+		}()
+		<-w.Ready()
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Post("https://"+w.WebhookAddr()+"/endpoint", "application/json", strings.NewReader("{}"))
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, proto, resp.Proto)
+		assert.Equal(t, proto, <-protoC)
+
+		client.Transport.(*http.Transport).CloseIdleConnections()
+		w.ShutdownWebhook()
+		wg.Wait()
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+	assert.Equal(t, 30*time.Second, w.newDialer().KeepAlive)
+
+	w, err = New(LoggerOption(logger), KeepAliveOption(5*time.Second), DialTimeoutOption(time.Second))
+	assert.Nil(t, err)
+	dialer := w.newDialer()
+	assert.Equal(t, 5*time.Second, dialer.KeepAlive)
+	assert.Equal(t, time.Second, dialer.Timeout)
+}
+
+func TestDNSCache(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// close connections to dial for each request.
+		w.Header().Set("Connection", "close")
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	assert.Nil(t, err)
+
+	w, err := New(LoggerOption(logger), DNSCacheOption(time.Minute))
+	assert.Nil(t, err)
+
+	var lookups int32
+	now := time.Now()
+	w.dnsCache.now = func() time.Time { return now }
+	w.dnsCache.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		atomic.AddInt32(&lookups, 1)
+		assert.Equal(t, "upstream.test", host)
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+
+	for i, want := range []int32{1, 1, 2} {
+		if i == 2 {
+			now = now.Add(time.Minute)
+		}
+		resp, err := w.Do(context.Background(), &Request{Method: "GET", URL: "http://upstream.test:" + port})
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, want, atomic.LoadInt32(&lookups))
+	}
+}
+
+func TestPostContextTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	w, err := New(LoggerOption(logger), TimeoutOption(time.Second*10))
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	start := time.Now()
+	var out interface{}
+	_, err = w.PostContext(ctx, ts.URL, nil, &out)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestWebhook(t *testing.T) {
+	endpoint := "/endpoint"
+	statusCode := http.StatusAccepted
+	data := postRequest{"data"}
+	dataBytes, err := json.Marshal(data)
+	port, err := freeport.GetFreePort()
+	assert.Nil(t, err)
+	listenAddr := fmt.Sprintf(":%d", port)
+
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		assert.Nil(t, w.StartWebhook(endpoint, listenAddr, func(req *http.Request) error {
+			assert.NotNil(t, req)
+			defer req.Body.Close()
+			var out postRequest
+			assert.Nil(t, json.NewDecoder(req.Body).Decode(&out))
+			assert.Equal(t, data.Message, out.Message)
+			return nil
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	url := webhookURL(t, w, endpoint)
+	resp, err := http.Post(url, "application/json", bytes.NewBuffer(dataBytes))
+	assert.Nil(t, err)
+	assert.Equal(t, statusCode, resp.StatusCode)
+	w.ShutdownWebhook()
+
+	wg.Wait()
+}
+
+func TestWebhookPathPrefixes(t *testing.T) {
+	w, err := New(LoggerOption(logger), WebhookPathPrefixesOption("/stripe/"))
+	assert.Nil(t, err)
+
+	pathC := make(chan string, 2)
+	go w.StartWebhook("/webhook", "127.0.0.1:0", func(req *http.Request) error {
+		pathC <- req.URL.Path
+		return nil
+	})
+	defer w.ShutdownWebhook()
+	<-w.Ready()
+
+	for _, path := range []string{"/webhook", "/stripe/payments", "/github"} {
+		resp, err := http.Post(webhookURL(t, w, path), "application/json", nil)
+		assert.Nil(t, err)
+		if path == "/github" {
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+			continue
+		}
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.Equal(t, path, <-pathC)
+	}
+}
+
+func TestWebhookErrorCode(t *testing.T) {
+	endpoint := "/endpoint"
+	statusCode := http.StatusBadRequest
+	port, err := freeport.GetFreePort()
+	assert.Nil(t, err)
+	listenAddr := fmt.Sprintf(":%d", port)
+
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+	assert.NotNil(t, w)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		assert.Nil(t, w.StartWebhook(endpoint, listenAddr, func(req *http.Request) error {
+			return errors.New("")
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	url := webhookURL(t, w, endpoint)
+	resp, err := http.Post(url, "application/json", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, statusCode, resp.StatusCode)
+	w.ShutdownWebhook()
+
+	wg.Wait()
+}
+
+func TestWebhookStatusError(t *testing.T) {
+	endpoint := "/endpoint"
+	port, err := freeport.GetFreePort()
+	assert.Nil(t, err)
+	listenAddr := fmt.Sprintf(":%d", port)
+
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	codes := []int{http.StatusOK, http.StatusTooManyRequests}
+	i := 0
+	go func() {
+		assert.Nil(t, w.StartWebhook(endpoint, listenAddr, func(req *http.Request) error {
+			code := codes[i]
+			i++
+			if code == http.StatusOK {
+				return &StatusError{Code: code}
+			}
+			return &StatusError{Code: code, Err: errors.New("slow down")}
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	url := webhookURL(t, w, endpoint)
+	for _, code := range codes {
+		resp, err := http.Post(url, "application/json", nil)
+		assert.Nil(t, err)
+		assert.Equal(t, code, resp.StatusCode)
+		resp.Body.Close()
+	}
+	w.ShutdownWebhook()
+
+	wg.Wait()
+}
+
+func TestWebhookGzipBody(t *testing.T) {
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+
+	bodyC := make(chan string, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		assert.Nil(t, w.StartWebhook("/endpoint", "127.0.0.1:0", func(req *http.Request) error {
+			assert.Equal(t, "", req.Header.Get("Content-Encoding"))
+			data, err := ioutil.ReadAll(req.Body)
+			assert.Nil(t, err)
+			bodyC <- string(data)
+			return nil
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err = gw.Write([]byte(`{"event":"paid"}`))
+	assert.Nil(t, err)
+	assert.Nil(t, gw.Close())
+
+	req, err := http.NewRequest("POST", webhookURL(t, w, "/endpoint"), &buf)
+	assert.Nil(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, `{"event":"paid"}`, <-bodyC)
+
+	req, err = http.NewRequest("POST", webhookURL(t, w, "/endpoint"), bytes.NewBufferString(`{"event":"paid"}`))
+	assert.Nil(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, 0, len(bodyC))
+
+	w.ShutdownWebhook()
+	wg.Wait()
+}
+
+func TestWebhookMaxHeaderBytes(t *testing.T) {
+	w, err := New(LoggerOption(logger), WebhookMaxHeaderBytesOption(1024))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		assert.Nil(t, w.StartWebhook("/endpoint", "127.0.0.1:0", func(req *http.Request) error {
+			return nil
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	req, err := http.NewRequest("POST", webhookURL(t, w, "/endpoint"), nil)
+	assert.Nil(t, err)
+	req.Header.Set("X-Signature", "signature")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	// net/http allows a few kilobytes over the limit.
+	req, err = http.NewRequest("POST", webhookURL(t, w, "/endpoint"), nil)
+	assert.Nil(t, err)
+	req.Header.Set("X-Signature", strings.Repeat("a", 16<<10))
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+
+	w.ShutdownWebhook()
+	wg.Wait()
+}
+
+func TestWebhookMethods(t *testing.T) {
+	w, err := New(LoggerOption(logger), WebhookMethodsOption("get", "POST"))
+	assert.Nil(t, err)
+
+	methodC := make(chan string, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		assert.Nil(t, w.StartWebhook("/endpoint", "127.0.0.1:0", func(req *http.Request) error {
+			methodC <- req.Method
+			return nil
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	for _, method := range []string{"GET", "POST"} {
+		req, err := http.NewRequest(method, webhookURL(t, w, "/endpoint"), nil)
+		assert.Nil(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.Equal(t, method, <-methodC)
+	}
+
+	req, err := http.NewRequest("PUT", webhookURL(t, w, "/endpoint"), nil)
+	assert.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	w.ShutdownWebhook()
+	wg.Wait()
+}
+
+func TestUpdateWebhookRoutes(t *testing.T) {
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+	assert.NotNil(t, w.UpdateWebhookRoutes(nil))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		assert.Nil(t, w.StartWebhook("/endpoint", "127.0.0.1:0", func(req *http.Request) error {
+			return nil
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	post := func(path string) int {
+		resp, err := http.Post(webhookURL(t, w, path), "application/json", nil)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusAccepted, post("/endpoint"))
+	assert.Equal(t, http.StatusNotFound, post("/github"))
+
+	var calls int32
+	assert.Nil(t, w.UpdateWebhookRoutes(map[string]func(*http.Request) error{
+		"/github": func(req *http.Request) error {
+			atomic.AddInt32(&calls, 1)
+			return &StatusError{Code: http.StatusOK}
+		},
 	}))
-	defer ts.Close()
+	assert.Equal(t, http.StatusOK, post("/github"))
+	assert.Equal(t, http.StatusAccepted, post("/endpoint"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	assert.NotNil(t, w.UpdateWebhookRoutes(map[string]func(*http.Request) error{"/nil": nil}))
+	assert.Equal(t, http.StatusOK, post("/github"))
+
+	assert.Nil(t, w.UpdateWebhookRoutes(nil))
+	assert.Equal(t, http.StatusNotFound, post("/github"))
+	assert.Equal(t, http.StatusAccepted, post("/endpoint"))
+
+	w.ShutdownWebhook()
+	wg.Wait()
+	assert.NotNil(t, w.UpdateWebhookRoutes(nil))
+}
 
+func TestWebhookValidationError(t *testing.T) {
 	w, err := New(LoggerOption(logger))
 	assert.Nil(t, err)
-	assert.NotNil(t, w)
 
-	var out postRequest
-	statusCode1, err := w.Post(ts.URL, data, &out)
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		assert.Nil(t, w.StartWebhook("/endpoint", "127.0.0.1:0", func(req *http.Request) error {
+			return &StatusError{
+				Code: http.StatusBadRequest,
+				Err: &ValidationError{
+					Message:  "invalid body",
+					Messages: []string{"id is required", "name is required"},
+				},
+			}
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	resp, err := http.Post(webhookURL(t, w, "/endpoint"), "application/json", nil)
 	assert.Nil(t, err)
-	assert.Equal(t, statusCode, statusCode1)
-	assert.Equal(t, data.Message, out.Message)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var out errorResponse
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&out))
+	assert.Equal(t, "invalid body: id is required; name is required", out.Error.Message)
+	assert.Equal(t, []string{"id is required", "name is required"}, out.Error.Messages)
+
+	w.ShutdownWebhook()
+	wg.Wait()
 }
 
-func TestWebhook(t *testing.T) {
+func TestWebhookReadTimeout(t *testing.T) {
 	endpoint := "/endpoint"
-	statusCode := http.StatusAccepted
-	data := postRequest{"data"}
-	dataBytes, err := json.Marshal(data)
 	port, err := freeport.GetFreePort()
 	assert.Nil(t, err)
 	listenAddr := fmt.Sprintf(":%d", port)
 
-	w, err := New(LoggerOption(logger))
+	w, err := New(
+		LoggerOption(logger),
+		WebhookServerTimeoutsOption(time.Millisecond*100, 0, 0),
+	)
 	assert.Nil(t, err)
-	assert.NotNil(t, w)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 
 	go func() {
 		assert.Nil(t, w.StartWebhook(endpoint, listenAddr, func(req *http.Request) error {
-			assert.NotNil(t, req)
-			defer req.Body.Close()
-			var out postRequest
-			assert.Nil(t, json.NewDecoder(req.Body).Decode(&out))
-			assert.Equal(t, data.Message, out.Message)
 			return nil
 		}))
 		wg.Done()
 	}()
-	time.Sleep(time.Millisecond * 100)
+	<-w.Ready()
 
-	url := fmt.Sprintf("http://127.0.0.1%s%s", w.WebhookAddr(), endpoint)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(dataBytes))
+	conn, err := net.Dial("tcp", webhookURL(t, w, "")[len("http://"):])
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("POST /endpoint HTTP/1.1\r\nHost: localhost\r\n"))
 	assert.Nil(t, err)
-	assert.Equal(t, statusCode, resp.StatusCode)
-	w.ShutdownWebhook()
 
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = ioutil.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) < time.Second*2)
+
+	w.ShutdownWebhook()
 	wg.Wait()
 }
 
-func TestWebhookErrorCode(t *testing.T) {
+func TestWebhookAccessLog(t *testing.T) {
 	endpoint := "/endpoint"
-	statusCode := http.StatusBadRequest
 	port, err := freeport.GetFreePort()
 	assert.Nil(t, err)
 	listenAddr := fmt.Sprintf(":%d", port)
 
-	w, err := New(LoggerOption(logger))
+	var buf bytes.Buffer
+	w, err := New(
+		LoggerOption(log.New(&buf, "", 0)),
+		WebhookAccessLogOption(true),
+	)
 	assert.Nil(t, err)
-	assert.NotNil(t, w)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 
 	go func() {
 		assert.Nil(t, w.StartWebhook(endpoint, listenAddr, func(req *http.Request) error {
-			return errors.New("")
+			return nil
 		}))
 		wg.Done()
 	}()
-	time.Sleep(time.Millisecond * 100)
+	<-w.Ready()
 
-	url := fmt.Sprintf("http://127.0.0.1%s%s", w.WebhookAddr(), endpoint)
+	url := webhookURL(t, w, endpoint)
 	resp, err := http.Post(url, "application/json", nil)
 	assert.Nil(t, err)
-	assert.Equal(t, statusCode, resp.StatusCode)
+	resp.Body.Close()
+	w.ShutdownWebhook()
+	wg.Wait()
+
+	assert.Contains(t, buf.String(), "POST /endpoint 202")
+}
+
+func TestWebhookRequestID(t *testing.T) {
+	endpoint := "/endpoint"
+	header := "X-Request-ID"
+	port, err := freeport.GetFreePort()
+	assert.Nil(t, err)
+	listenAddr := fmt.Sprintf(":%d", port)
+
+	w, err := New(LoggerOption(logger), WebhookRequestIDHeaderOption(header))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	idC := make(chan string, 2)
+	go func() {
+		assert.Nil(t, w.StartWebhook(endpoint, listenAddr, func(req *http.Request) error {
+			idC <- RequestID(req.Context())
+			return nil
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	url := webhookURL(t, w, endpoint)
+
+	req, err := http.NewRequest("POST", url, nil)
+	assert.Nil(t, err)
+	req.Header.Set(header, "id")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "id", resp.Header.Get(header))
+	assert.Equal(t, "id", <-idC)
+
+	resp, err = http.Post(url, "application/json", nil)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	id := resp.Header.Get(header)
+	assert.NotEmpty(t, id)
+	assert.Equal(t, id, <-idC)
+
+	w.ShutdownWebhook()
+	wg.Wait()
+}
+
+func TestWebhookRateLimitInvalidBurst(t *testing.T) {
+	_, err := New(LoggerOption(logger), WebhookRateLimitOption(1, 0))
+	assert.EqualError(t, err, "rate limit burst must be at least 1")
+}
+
+func TestWebhookRateLimit(t *testing.T) {
+	endpoint := "/endpoint"
+	port, err := freeport.GetFreePort()
+	assert.Nil(t, err)
+	listenAddr := fmt.Sprintf(":%d", port)
+
+	w, err := New(LoggerOption(logger), WebhookRateLimitOption(1, 2))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		assert.Nil(t, w.StartWebhook(endpoint, listenAddr, func(req *http.Request) error {
+			return nil
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	url := webhookURL(t, w, endpoint)
+	var accepted, limited int
+	for i := 0; i < 5; i++ {
+		resp, err := http.Post(url, "application/json", nil)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusAccepted:
+			accepted++
+		case http.StatusTooManyRequests:
+			limited++
+			assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+		}
+	}
+	assert.Equal(t, 2, accepted)
+	assert.Equal(t, 3, limited)
+
+	w.ShutdownWebhook()
+	wg.Wait()
+}
+
+func TestWebhookGracefulTimeout(t *testing.T) {
+	endpoint := "/endpoint"
+	port, err := freeport.GetFreePort()
+	assert.Nil(t, err)
+	listenAddr := fmt.Sprintf(":%d", port)
+
+	w, err := New(
+		LoggerOption(logger),
+		TimeoutOption(time.Millisecond*10),
+		GracefulTimeoutOption(time.Second*5),
+	)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	hitC := make(chan struct{})
+	go func() {
+		assert.Nil(t, w.StartWebhook(endpoint, listenAddr, func(req *http.Request) error {
+			close(hitC)
+			time.Sleep(time.Millisecond * 300)
+			return nil
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	respC := make(chan int)
+	url := webhookURL(t, w, endpoint)
+	go func() {
+		resp, err := http.Post(url, "application/json", nil)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		respC <- resp.StatusCode
+	}()
+	<-hitC
+
+	start := time.Now()
+	shutdownC := make(chan struct{})
+	go func() {
+		w.ShutdownWebhook()
+		close(shutdownC)
+	}()
+
+	// the address is still readable while draining.
+	time.Sleep(time.Millisecond * 50)
+	addrC := make(chan string)
+	go func() { addrC <- w.WebhookAddr() }()
+	select {
+	case addr := <-addrC:
+		assert.NotEmpty(t, addr)
+	case <-time.After(time.Millisecond * 100):
+		t.Fatal("webhook addr is blocked by shutdown")
+	}
+
+	<-shutdownC
+	assert.True(t, time.Since(start) >= time.Millisecond*200)
+	assert.Equal(t, http.StatusAccepted, <-respC)
+
+	wg.Wait()
+}
+
+func TestWebhookAddrBeforeStart(t *testing.T) {
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+	assert.Equal(t, "", w.WebhookAddr())
+}
+
+func TestShutdownWebhookIdempotent(t *testing.T) {
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+
+	port, err := freeport.GetFreePort()
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		assert.Nil(t, w.StartWebhook("/endpoint", fmt.Sprintf(":%d", port), func(req *http.Request) error {
+			return nil
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	assert.NotPanics(t, w.ShutdownWebhook)
+	assert.NotPanics(t, w.ShutdownWebhook)
+	wg.Wait()
+}
+
+func TestShutdownWebhookBeforeStart(t *testing.T) {
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+	assert.NotPanics(t, w.ShutdownWebhook)
+
+	err = w.StartWebhook("/endpoint", "127.0.0.1:0", func(req *http.Request) error {
+		return nil
+	})
+	assert.Equal(t, http.ErrServerClosed, err)
+}
+
+func TestStartWebhookAddrInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+
+	err = w.StartWebhook("/endpoint", l.Addr().String(), func(req *http.Request) error {
+		return nil
+	})
+	assert.Equal(t, ErrAddrInUse, err)
+}
+
+func TestWebhookRandomPort(t *testing.T) {
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		assert.Nil(t, w.StartWebhook("/endpoint", ":0", func(req *http.Request) error {
+			return nil
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	_, port, err := net.SplitHostPort(w.WebhookAddr())
+	assert.Nil(t, err)
+	assert.NotEqual(t, "0", port)
+
+	resp, err := http.Post(webhookURL(t, w, "/endpoint"), "application/json", nil)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	w.ShutdownWebhook()
+	wg.Wait()
+}
+
+func TestWebhookReady(t *testing.T) {
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+
+	select {
+	case <-w.Ready():
+		t.Fatal("ready before webhook started")
+	default:
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		assert.Nil(t, w.StartWebhook("/endpoint", ":0", func(req *http.Request) error {
+			return nil
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	resp, err := http.Post(webhookURL(t, w, "/endpoint"), "application/json", nil)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	w.ShutdownWebhook()
+	wg.Wait()
+}
+
+func TestWebhookActiveConnections(t *testing.T) {
+	w, err := New(LoggerOption(logger))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		assert.Nil(t, w.StartWebhook("/endpoint", ":0", func(req *http.Request) error {
+			return nil
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+	assert.Equal(t, 0, w.ActiveConnections())
+
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Post(webhookURL(t, w, "/endpoint"), "application/json", nil)
+	assert.Nil(t, err)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 1, w.ActiveConnections())
+
 	w.ShutdownWebhook()
+	wg.Wait()
+	waitFor(t, func() bool { return w.ActiveConnections() == 0 })
+}
+
+// waitFor waits until cond is met or fails the test after a while.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second * 2)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestWebhookMiddleware(t *testing.T) {
+	var order []string
+	mw := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				rw.Header().Set("X-"+name, "1")
+				next.ServeHTTP(rw, r)
+			})
+		}
+	}
+
+	w, err := New(LoggerOption(logger), WebhookMiddlewareOption(mw("First"), mw("Second")))
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		assert.Nil(t, w.StartWebhook("/endpoint", ":0", func(req *http.Request) error {
+			order = append(order, "handler")
+			return nil
+		}))
+		wg.Done()
+	}()
+	<-w.Ready()
+
+	resp, err := http.Post(webhookURL(t, w, "/endpoint"), "application/json", nil)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("X-First"))
+	assert.Equal(t, "1", resp.Header.Get("X-Second"))
+	assert.Equal(t, []string{"First", "Second", "handler"}, order)
 
+	w.ShutdownWebhook()
 	wg.Wait()
 }